@@ -0,0 +1,210 @@
+package parseur
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// the number of bytes searched for a <meta> charset declaration
+const prescanLength = 1024
+
+var byteOrderMarks = []struct {
+	mark     []byte
+	encoding string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+	{[]byte{0xFE, 0xFF}, "utf-16be"},
+	{[]byte{0xFF, 0xFE}, "utf-16le"},
+}
+
+// determines the character encoding of a document, a byte order mark wins
+// over the Content-Type header which wins over a <meta> declaration in the
+// first 1024 bytes, undeclared documents are utf-8 if they decode as such
+// and windows-1252 otherwise
+func DetectEncoding(data []byte, contentType string) string {
+	name, _ := detectEncoding(data, contentType)
+	return name
+}
+
+// transcodes a document to utf-8, stripping a byte order mark, and returns
+// the encoding it was detected in
+func DecodeToUTF8(data []byte, contentType string) ([]byte, string, error) {
+	name, bom := detectEncoding(data, contentType)
+	data = data[bom:]
+
+	if name == "utf-8" {
+		return data, name, nil
+	}
+
+	decoded, err := lookupEncoding(name).NewDecoder().Bytes(data)
+
+	return decoded, name, err
+}
+
+// wraps a reader so it yields utf-8, sniffing the encoding from what can be
+// peeked without consuming the stream
+func decodingReader(r *bufio.Reader, contentType string) (*bufio.Reader, string) {
+	head, _ := r.Peek(prescanLength)
+	name, bom := detectEncoding(head, contentType)
+	_, _ = r.Discard(bom)
+
+	if name == "utf-8" {
+		return r, name
+	}
+
+	return bufio.NewReader(transform.NewReader(r, lookupEncoding(name).NewDecoder())), name
+}
+
+func detectEncoding(data []byte, contentType string) (string, int) {
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(data, bom.mark) {
+			return bom.encoding, len(bom.mark)
+		}
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if name := canonicalEncoding(params["charset"]); name != "" {
+			return name, 0
+		}
+	}
+
+	head := data[:min(len(data), prescanLength)]
+
+	if name := canonicalEncoding(prescanCharset(head)); name != "" {
+		// a document that declares utf-16 in ascii can't be utf-16
+		if strings.HasPrefix(name, "utf-16") {
+			return "utf-8", 0
+		}
+
+		return name, 0
+	}
+
+	if validPrefix(head, len(data) > len(head)) {
+		return "utf-8", 0
+	}
+
+	return "windows-1252", 0
+}
+
+// the head may end in the middle of a character when the document is longer
+func validPrefix(head []byte, truncated bool) bool {
+	if !truncated {
+		return utf8.Valid(head)
+	}
+
+	for i := 0; i < utf8.UTFMax && i < len(head); i++ {
+		if utf8.Valid(head[:len(head)-i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finds the first <meta charset> or <meta http-equiv="content-type">
+// declaration, the head is tokenized so declarations in comments and
+// scripts are skipped and a tag cut off at its end is text
+func prescanCharset(head []byte) string {
+	tokenizer := NewTokenizer(bytes.NewReader(head))
+
+	for tokenizer.Next() {
+		token := tokenizer.Token()
+		isTag := token.Type == StartTagToken || token.Type == SelfClosingTagToken
+
+		if !isTag || !bytes.EqualFold(token.Name, []byte("meta")) {
+			continue
+		}
+
+		if charset := metaCharset(token.Attributes); charset != "" {
+			return charset
+		}
+	}
+
+	return ""
+}
+
+func metaCharset(attributes []TokenAttribute) string {
+	var httpEquiv, content string
+
+	for _, attribute := range attributes {
+		switch strings.ToLower(string(attribute.Name)) {
+		case "charset":
+			return string(attribute.Value)
+		case "http-equiv":
+			httpEquiv = string(attribute.Value)
+		case "content":
+			content = string(attribute.Value)
+		}
+	}
+
+	if !strings.EqualFold(httpEquiv, "content-type") {
+		return ""
+	}
+
+	return charsetParameter(content)
+}
+
+// extracts the charset from a content attribute, which unlike the header
+// isn't required to be a well-formed media type
+func charsetParameter(content string) string {
+	index := strings.Index(strings.ToLower(content), "charset")
+
+	if index == -1 {
+		return ""
+	}
+
+	value := strings.TrimLeft(content[index+len("charset"):], " \t\n\f\r")
+
+	if !strings.HasPrefix(value, "=") {
+		return ""
+	}
+
+	value = strings.TrimLeft(value[1:], " \t\n\f\r")
+
+	if value != "" && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end != -1 {
+			return value[1 : end+1]
+		}
+
+		return ""
+	}
+
+	if end := strings.IndexAny(value, " \t\n\f\r;"); end != -1 {
+		return value[:end]
+	}
+
+	return value
+}
+
+// maps an encoding label to its whatwg name, unknown labels map to ""
+func canonicalEncoding(label string) string {
+	if label == "" {
+		return ""
+	}
+
+	e, err := htmlindex.Get(strings.TrimSpace(label))
+
+	if err != nil {
+		return ""
+	}
+
+	name, err := htmlindex.Name(e)
+
+	if err != nil {
+		return ""
+	}
+
+	return name
+}
+
+func lookupEncoding(name string) encoding.Encoding {
+	e, _ := htmlindex.Get(name)
+	return e
+}
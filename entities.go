@@ -0,0 +1,73 @@
+package parseur
+
+import (
+	"html"
+	"strings"
+)
+
+func unescapeAttribute(value string) string {
+	if strings.IndexByte(value, '&') == -1 {
+		return value
+	}
+
+	builder := strings.Builder{}
+	length := len(value)
+
+	for i := 0; i < length; {
+		k := i + 1
+
+		for k < length && value[k] != '&' {
+			k++
+		}
+
+		if value[i] != '&' || isLegacyReference(value[i:k]) {
+			builder.WriteString(value[i:k])
+		} else {
+			builder.WriteString(html.UnescapeString(value[i:k]))
+		}
+
+		i = k
+	}
+
+	return builder.String()
+}
+
+// in attribute values, a named reference that only matches a prefix of its name
+// or is directly followed by '=' is kept verbatim, so query strings like
+// "?a=1&copy=2" survive decoding
+func isLegacyReference(chunk string) bool {
+	length := len(chunk)
+	i := 1
+
+	for i < length && isAlphanumeric(chunk[i]) {
+		i++
+	}
+
+	if i == 1 {
+		return false
+	}
+
+	end := i
+
+	if i < length && chunk[i] == ';' {
+		end++
+	} else if i < length && chunk[i] == '=' {
+		return true
+	}
+
+	decoded := html.UnescapeString(chunk[:end])
+
+	for k := 0; k < len(decoded); k++ {
+		if isAlphanumeric(decoded[k]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAlphanumeric(c byte) bool {
+	return ('0' <= c && c <= '9') ||
+		('A' <= c && c <= 'Z') ||
+		('a' <= c && c <= 'z')
+}
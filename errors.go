@@ -0,0 +1,93 @@
+package parseur
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ParseErrorKind int
+
+const (
+	UnclosedTag ParseErrorKind = iota
+	UnexpectedEndTag
+	BadAttribute
+	UnterminatedComment
+	UnterminatedRawText
+	UnterminatedCData
+	UnterminatedTag
+)
+
+type ParseError struct {
+	Kind ParseErrorKind
+	Name string
+	Position
+}
+
+type parseErrorKey struct {
+	kind   ParseErrorKind
+	offset int
+}
+
+func (e *ParseError) Error() string {
+	var message string
+
+	switch e.Kind {
+	case UnclosedTag:
+		message = fmt.Sprintf("unclosed tag <%s>", e.Name)
+	case UnexpectedEndTag:
+		message = fmt.Sprintf("unexpected end tag </%s>", e.Name)
+	case BadAttribute:
+		message = fmt.Sprintf("bad attribute '%s'", e.Name)
+	case UnterminatedComment:
+		message = "unterminated comment"
+	case UnterminatedRawText:
+		message = fmt.Sprintf("unterminated <%s>", e.Name)
+	case UnterminatedCData:
+		message = "unterminated cdata section"
+	case UnterminatedTag:
+		message = fmt.Sprintf("unterminated tag <%s>", e.Name)
+	}
+
+	return fmt.Sprintf("%s at line %d, column %d", message, e.Line, e.Column)
+}
+
+// errors are reported once per offset, the parser revisits markup when it
+// hoists the children of an unclosed tag. queries scanning the body once it
+// is parsed report nothing
+func (p *Parser) addError(kind ParseErrorKind, name string, offset int) {
+	if p.Done {
+		return
+	}
+
+	key := parseErrorKey{kind, offset}
+
+	if p.reported == nil {
+		p.reported = make(map[parseErrorKey]struct{})
+	}
+
+	if _, ok := p.reported[key]; ok {
+		return
+	}
+
+	p.reported[key] = struct{}{}
+	p.errors = append(p.errors, &ParseError{Kind: kind, Name: name, Position: Position{Offset: offset}})
+}
+
+// the problems found in the markup so far, in document order. the errors
+// are copies with their positions resolved, the recorded ones stay as the
+// parser left them
+func (p *Parser) Errors() []*ParseError {
+	errors := make([]*ParseError, len(p.errors))
+
+	for i, err := range p.errors {
+		copied := *err
+		copied.Position = p.Position(err.Offset)
+		errors[i] = &copied
+	}
+
+	sort.SliceStable(errors, func(a, b int) bool {
+		return errors[a].Offset < errors[b].Offset
+	})
+
+	return errors
+}
@@ -15,16 +15,18 @@ func fetchOpenGraphTags() {
 			return
 		}
 
-		htmlTags := *p.Query("meta").Get()
+		htmlTags := p.Query(`meta[property="og:video:tag"]`).Get()
 
 		p.InBound = func(i int) bool {
 			return false
 		}
 
-		for _, u := range htmlTags {
-			if token, ok := u.Attributes["property"]; ok && token == "og:video:tag" {
-				println(u.Attributes["content"])
-			}
+		if htmlTags == nil {
+			return
+		}
+
+		for _, u := range *htmlTags {
+			println(u.Attributes["content"])
 		}
 	}
 
@@ -0,0 +1,586 @@
+package parseur
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrHierarchy  = errors.New("a tag can't be inserted into itself or its descendants")
+	ErrNotChild   = errors.New("the reference tag is not a child of the tag")
+	ErrNoContent  = errors.New("the element can't have content")
+	ErrRoot       = errors.New("the document root has no markup")
+	ErrForeignTag = errors.New("the tag belongs to another parser")
+	ErrAttribute  = errors.New("invalid attribute name")
+	ErrNoMarkup   = errors.New("the tag belongs to a tree without markup")
+)
+
+var (
+	textEscaper    = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	rawTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;")
+	// entities are kept as they are with Options.RawEntities
+	markupEscaper = strings.NewReplacer("<", "&lt;")
+)
+
+// creates a detached element, it becomes part of the document once it's
+// appended or inserted somewhere
+func (p *Parser) CreateElement(name string) *Tag {
+	t := &Tag{Children: make([]*Tag, 0), Attributes: make(map[string]string), parser: p}
+
+	if prefix, local, ok := strings.Cut(name, ":"); ok {
+		t.Namespace = p.normalizeName(prefix)
+		name = local
+	}
+
+	t.Name = p.normalizeName(name)
+	start := "<" + t.qualifiedName() + ">"
+	markup := []byte(start)
+
+	if _, ok := selfclosingTagsMap[t.Name]; !ok || p.xml {
+		markup = append(markup, "</"+t.qualifiedName()+">"...)
+		t.Body = Offset{len(start), len(start)}
+	}
+
+	t.Tag = Offset{0, len(markup)}
+	t.fragment = &markup
+
+	return t
+}
+
+func (t *Tag) AppendChild(child *Tag) error {
+	return t.InsertBefore(child, nil)
+}
+
+// inserts child in front of ref, or at the end if ref is nil, a child that
+// is already part of a tree is moved
+func (t *Tag) InsertBefore(child *Tag, ref *Tag) error {
+	p := t.parser
+
+	if child.parser != p {
+		return ErrForeignTag
+	}
+
+	if !t.hasMarkup() || !child.hasMarkup() {
+		return ErrNoMarkup
+	}
+
+	if !t.hasContent() || t.isRawText() {
+		return ErrNoContent
+	}
+
+	for tag := t; tag != nil; tag = tag.parent {
+		if tag == child {
+			return ErrHierarchy
+		}
+	}
+
+	if child == p.root {
+		return ErrRoot
+	}
+
+	if ref != nil && ref.parent != t {
+		return ErrNotChild
+	}
+
+	if ref == child {
+		return nil
+	}
+
+	child.Remove()
+
+	point := t.contentEnd()
+	index := len(t.Children)
+
+	if ref != nil {
+		point = ref.Tag.Start
+		index = ref.Index()
+	}
+
+	top := t.top()
+	fragment := *child.fragment
+
+	p.splice(top, t, point, point, fragment)
+	child.shift(point)
+	child.fragment = nil
+	child.parent = t
+
+	t.Children = append(t.Children, nil)
+	copy(t.Children[index+1:], t.Children[index:])
+	t.Children[index] = child
+
+	if p.nodes {
+		node := &Node{Type: ElementNode, Tag: child, Offset: child.Tag, Data: child.Body, parent: t}
+		position := len(t.Nodes)
+
+		if ref != nil {
+			position = ref.node().Index()
+		}
+
+		t.Nodes = append(t.Nodes, nil)
+		copy(t.Nodes[position+1:], t.Nodes[position:])
+		t.Nodes[position] = node
+	}
+
+	p.reindex(top)
+
+	return nil
+}
+
+// detaches the tag with its subtree, its markup moves along with it so it
+// can be inserted again
+func (t *Tag) Remove() {
+	if t.parent == nil || !t.hasMarkup() {
+		return
+	}
+
+	p := t.parser
+	top := t.top()
+	start, end := t.Tag.Start, t.Tag.End
+	buffer := *p.buffer(top)
+	parent := t.parent
+
+	p.splice(top, parent, start, end, nil)
+
+	if index := t.Index(); index != -1 {
+		parent.Children = append(parent.Children[:index], parent.Children[index+1:]...)
+	}
+
+	if node := t.node(); node != nil {
+		index := node.Index()
+		parent.Nodes = append(parent.Nodes[:index], parent.Nodes[index+1:]...)
+	}
+
+	t.detach(buffer)
+	p.reindex(top)
+}
+
+// gives a tag taken out of its tree a copy of its markup
+func (t *Tag) detach(buffer []byte) {
+	fragment := bytes.Clone(buffer[t.Tag.Start:t.Tag.End])
+	t.parent = nil
+	t.fragment = &fragment
+	t.shift(-t.Tag.Start)
+}
+
+func (t *Tag) ReplaceWith(other *Tag) error {
+	if t.parent == nil {
+		return ErrNotChild
+	}
+
+	if other == t {
+		return nil
+	}
+
+	if err := t.parent.InsertBefore(other, t); err != nil {
+		return err
+	}
+
+	t.Remove()
+
+	return nil
+}
+
+// puts wrapper in the tag's place and moves the tag into it
+func (t *Tag) Wrap(wrapper *Tag) error {
+	// checked up front, the tag would be detached by the time appending fails
+	if !wrapper.hasContent() || wrapper.isRawText() {
+		return ErrNoContent
+	}
+
+	if err := t.ReplaceWith(wrapper); err != nil {
+		return err
+	}
+
+	return wrapper.AppendChild(t)
+}
+
+func (t *Tag) SetAttr(name string, value string) error {
+	if t.parser.root == t {
+		return ErrRoot
+	}
+
+	if !t.hasMarkup() {
+		return ErrNoMarkup
+	}
+
+	if !validAttributeName(name) {
+		return ErrAttribute
+	}
+
+	name = t.parser.normalizeName(name)
+	t.Attributes[name] = value
+
+	if prefix, ok := strings.CutPrefix(name, "xmlns:"); ok {
+		t.parser.namespaces[prefix] = value
+	}
+
+	t.parser.rewriteStartTag(t)
+
+	return nil
+}
+
+func (t *Tag) RemoveAttr(name string) {
+	name = t.parser.normalizeName(name)
+
+	if _, ok := t.Attributes[name]; !ok || t.parser.root == t || !t.hasMarkup() {
+		return
+	}
+
+	delete(t.Attributes, name)
+	t.parser.rewriteStartTag(t)
+}
+
+// replaces the content of the element with text, which is escaped unless
+// the element holds raw text. with Options.RawEntities the text is taken
+// as it is read back, only '<' is escaped
+func (t *Tag) SetText(text string) error {
+	if !t.hasContent() {
+		return ErrNoContent
+	}
+
+	if !t.hasMarkup() {
+		return ErrNoMarkup
+	}
+
+	p := t.parser
+	top := t.top()
+	start, end := t.contentStart(), t.contentEnd()
+	buffer := *p.buffer(top)
+	children := t.Children
+	t.Children = make([]*Tag, 0)
+	t.Nodes = nil
+
+	escapable, ok := p.rawText(t)
+
+	switch {
+	case ok && !escapable:
+		// script and style can't hold entities
+	case p.rawEntities:
+		text = markupEscaper.Replace(text)
+	case ok:
+		text = rawTextEscaper.Replace(text)
+	default:
+		text = textEscaper.Replace(text)
+	}
+
+	p.splice(top, t, start, end, []byte(text))
+
+	// the replaced children can still be inserted somewhere else
+	for _, child := range children {
+		child.detach(buffer)
+	}
+
+	p.addText(t, start, start+len(text))
+	p.reindex(top)
+
+	return nil
+}
+
+// the detached tree or document the tag belongs to
+func (t *Tag) top() *Tag {
+	top := t
+
+	for top.parent != nil {
+		top = top.parent
+	}
+
+	return top
+}
+
+// a tree is edited through the markup of the document or of its detached
+// top tag
+func (t *Tag) hasMarkup() bool {
+	top := t.top()
+
+	return top == t.parser.root || top.fragment != nil
+}
+
+func (p *Parser) buffer(top *Tag) *[]byte {
+	if top == p.root {
+		return p.body
+	}
+
+	return top.fragment
+}
+
+func (t *Tag) hasContent() bool {
+	if t == t.parser.root {
+		return true
+	}
+
+	// void elements have no body, unclosed ones an open one
+	return (t.Body.Start != 0 || t.Body.End != 0) && t.Body.End != -1
+}
+
+func (t *Tag) isRawText() bool {
+	_, ok := t.parser.rawText(t)
+	return ok
+}
+
+func (t *Tag) contentStart() int {
+	return t.Body.Start
+}
+
+func (t *Tag) contentEnd() int {
+	if t == t.parser.root {
+		return len(*t.parser.body)
+	}
+
+	return t.Body.End
+}
+
+// the start tag ends where the body starts, or with the tag if it has none
+func (t *Tag) startTagEnd() int {
+	if t.Body.Start != 0 || t.Body.End != 0 {
+		return t.Body.Start
+	}
+
+	return t.Tag.End
+}
+
+// replaces start to end in the tree's markup and moves the offsets behind
+// the edit, container is the innermost tag whose body holds the edit. the
+// markup is copied on every edit, n edits cost n times the size of the tree
+func (p *Parser) splice(top *Tag, container *Tag, start, end int, replacement []byte) {
+	buffer := *p.buffer(top)
+	body := make([]byte, 0, len(buffer)-(end-start)+len(replacement))
+	body = append(append(append(body, buffer[:start]...), replacement...), buffer[end:]...)
+
+	if top == p.root {
+		p.body = &body
+		p.length = len(body)
+	} else {
+		top.fragment = &body
+	}
+
+	delta := len(replacement) - (end - start)
+
+	if delta == 0 {
+		return
+	}
+
+	containers := make(map[*Tag]struct{})
+
+	for tag := container; tag != nil; tag = tag.parent {
+		containers[tag] = struct{}{}
+	}
+
+	var walk func(tag *Tag)
+
+	walk = func(tag *Tag) {
+		if _, ok := containers[tag]; ok {
+			tag.shiftEnds(end, delta)
+		} else if tag.Tag.Start >= end {
+			tag.shift(delta)
+			return
+		} else if tag.Tag.End <= end {
+			return
+		}
+
+		for _, child := range tag.Children {
+			walk(child)
+		}
+
+		for _, node := range tag.Nodes {
+			if node.Type == ElementNode {
+				node.Offset, node.Data = node.Tag.Tag, node.Tag.Body
+			} else if node.Offset.Start >= end {
+				node.Offset = Offset{node.Offset.Start + delta, node.Offset.End + delta}
+				node.Data = Offset{node.Data.Start + delta, node.Data.End + delta}
+			}
+		}
+	}
+
+	walk(top)
+}
+
+// moves the ends of a tag containing an edit, and its body start if the
+// edit is in front of it
+func (t *Tag) shiftEnds(end int, delta int) {
+	if t.Body.Start > end {
+		t.Body.Start += delta
+	}
+
+	if t.Body.End >= end {
+		t.Body.End += delta
+	}
+
+	if t.Tag.End >= end && t != t.parser.root {
+		t.Tag.End += delta
+	}
+}
+
+// moves the tag and everything in it
+func (t *Tag) shift(delta int) {
+	t.Tag = Offset{t.Tag.Start + delta, t.Tag.End + delta}
+
+	if t.Body.Start != 0 || t.Body.End != 0 {
+		t.Body.Start += delta
+
+		if t.Body.End != -1 {
+			t.Body.End += delta
+		}
+	}
+
+	for _, child := range t.Children {
+		child.shift(delta)
+	}
+
+	for _, node := range t.Nodes {
+		if node.Type == ElementNode {
+			node.Offset, node.Data = node.Tag.Tag, node.Tag.Body
+		} else {
+			node.Offset = Offset{node.Offset.Start + delta, node.Offset.End + delta}
+			node.Data = Offset{node.Data.Start + delta, node.Data.End + delta}
+		}
+	}
+}
+
+// renders the start tag from the attributes, keeping the order of the
+// attributes that were already there
+func (p *Parser) rewriteStartTag(t *Tag) {
+	top := t.top()
+	start, end := t.Tag.Start, t.startTagEnd()
+	original := bytes.Clone((*p.buffer(top))[start:end])
+	replacement := p.renderStartTag(t, original, false)
+	delta := len(replacement) - len(original)
+
+	p.splice(top, t.parent, start, end, replacement)
+
+	// the tag itself straddles the edit
+	t.Tag.End += delta
+
+	if t.Body.Start != 0 || t.Body.End != 0 {
+		t.Body.Start += delta
+
+		if t.Body.End != -1 {
+			t.Body.End += delta
+		}
+	}
+
+	if node := t.node(); node != nil {
+		node.Offset, node.Data = t.Tag, t.Body
+	}
+
+	p.reindex(top)
+}
+
+// unquoted leaves out the quotes of values that don't need them
+func (p *Parser) renderStartTag(t *Tag, original []byte, unquoted bool) []byte {
+	tokenizer := NewTokenizer(bytes.NewReader(original))
+	builder := bytes.Buffer{}
+	written := make(map[string]struct{})
+
+	if !tokenizer.Next() {
+		return original
+	}
+
+	token := tokenizer.Token()
+	builder.WriteByte('<')
+	builder.WriteString(t.qualifiedName())
+
+	write := func(name string, valueless bool) {
+		value, ok := t.Attributes[name]
+
+		if _, done := written[name]; done || !ok {
+			return
+		}
+
+		written[name] = struct{}{}
+		builder.WriteByte(' ')
+		builder.WriteString(name)
+
+		if valueless && value == name {
+			return
+		}
+
+		if unquoted && unquotable(value) {
+			builder.WriteByte('=')
+			builder.WriteString(p.escapeAttribute(value))
+		} else {
+			builder.WriteString(`="`)
+			builder.WriteString(p.escapeAttribute(value))
+			builder.WriteByte('"')
+		}
+	}
+
+	for _, attribute := range token.Attributes {
+		write(p.normalizeName(string(attribute.Name)), len(attribute.Value) == 0)
+	}
+
+	names := make([]string, 0, len(t.Attributes))
+
+	for name := range t.Attributes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		write(name, false)
+	}
+
+	if token.Type == SelfClosingTagToken {
+		builder.WriteString("/>")
+	} else {
+		builder.WriteByte('>')
+	}
+
+	return builder.Bytes()
+}
+
+func (p *Parser) escapeAttribute(value string) string {
+	if p.rawEntities {
+		return strings.ReplaceAll(value, `"`, "&quot;")
+	}
+
+	return strings.NewReplacer("&", "&amp;", `"`, "&quot;").Replace(value)
+}
+
+// a trailing slash would be taken for the end of a self-closing tag
+func unquotable(value string) bool {
+	return value != "" && !strings.ContainsAny(value, " \t\n\r\f\"'=<>`") && !strings.HasSuffix(value, "/")
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c == '"' || c == '\'' || c == '>' || c == '/' || c == '=' || c == '<' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rebuilds the indexes of the document after an edit, detached trees are
+// not indexed. like splice it walks the whole document every time
+func (p *Parser) reindex(top *Tag) {
+	if top != p.root {
+		return
+	}
+
+	p.tagMap = make(map[string]*[]*Tag)
+	p.offsetMap = make(map[int]*Tag)
+	p.GetOffsetList = p.computeOffsetList
+	p.lines, p.indexed = nil, 0
+
+	var walk func(tag *Tag)
+
+	walk = func(tag *Tag) {
+		for _, child := range tag.Children {
+			p.offsetMap[child.Tag.Start] = child
+			p.addTag(child.Name, child)
+			p.addTag("*", child)
+			p.indexAttributes(child)
+			walk(child)
+		}
+	}
+
+	walk(p.root)
+}
@@ -0,0 +1,233 @@
+package parseur
+
+type NodeType int
+
+const (
+	ElementNode NodeType = iota
+	TextNode
+	CommentNode
+	CDataNode
+	DoctypeNode
+	ProcessingInstructionNode
+)
+
+type Node struct {
+	Type   NodeType
+	Tag    *Tag
+	Offset Offset
+	Data   Offset
+	parent *Tag
+}
+
+func (n *Node) Parent() *Tag {
+	return n.parent
+}
+
+func (n *Node) Index() int {
+	if n.parent == nil {
+		return -1
+	}
+
+	for i, node := range n.parent.Nodes {
+		if node == n {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (n *Node) Next() *Node {
+	index := n.Index()
+
+	if index == -1 || index+1 >= len(n.parent.Nodes) {
+		return nil
+	}
+
+	return n.parent.Nodes[index+1]
+}
+
+func (n *Node) Prev() *Node {
+	index := n.Index()
+
+	if index < 1 {
+		return nil
+	}
+
+	return n.parent.Nodes[index-1]
+}
+
+func (t *Tag) node() *Node {
+	if t.parent == nil {
+		return nil
+	}
+
+	for _, node := range t.parent.Nodes {
+		if node.Tag == t {
+			return node
+		}
+	}
+
+	return nil
+}
+
+func (t *Tag) NextNode() *Node {
+	if node := t.node(); node != nil {
+		return node.Next()
+	}
+
+	return nil
+}
+
+func (t *Tag) PrevNode() *Node {
+	if node := t.node(); node != nil {
+		return node.Prev()
+	}
+
+	return nil
+}
+
+func (p *Parser) NodeValue(n *Node) string {
+	if n == nil {
+		return ""
+	}
+
+	if n.Type == ElementNode {
+		return (&QueryTag{n.Tag, p}).InnerText()
+	}
+
+	if n.Type == TextNode {
+		return p.text(n.parent, n.Data.Start, n.Data.End)
+	}
+
+	return p.value(n.Data.Start, n.Data.End)
+}
+
+func (p *Parser) addNode(parent *Tag, nodeType NodeType, start, end int, data Offset) {
+	if !p.nodes {
+		return
+	}
+
+	node := &Node{Type: nodeType, Offset: Offset{start, end}, Data: data, parent: parent}
+	parent.Nodes = append(parent.Nodes, node)
+}
+
+func (p *Parser) addText(parent *Tag, start, end int) {
+	if start < end {
+		p.addNode(parent, TextNode, start, end, Offset{start, end})
+	}
+}
+
+func (p *Parser) addElement(parent *Tag, tag *Tag) {
+	p.addNode(parent, ElementNode, tag.Tag.Start, tag.Tag.End, tag.Body)
+	parent.Nodes[len(parent.Nodes)-1].Tag = tag
+}
+
+func (p *Parser) commentData(start, end int) Offset {
+	dataEnd := end
+
+	if end-start >= 5 && string((*p.body)[end-3:end]) == "-->" {
+		dataEnd = end - 3
+	}
+
+	return Offset{start + 4, max(start+4, dataEnd)}
+}
+
+// the content between the delimiters of a section, which may be
+// unterminated
+func (p *Parser) sectionData(start, end int, open int, close string) Offset {
+	dataEnd := end
+
+	if end-start >= open+len(close) && string((*p.body)[end-len(close):end]) == close {
+		dataEnd = end - len(close)
+	} else if close == "?>" && end-start > open && (*p.body)[end-1] == '>' {
+		dataEnd = end - 1
+	}
+
+	return Offset{start + open, max(start+open, dataEnd)}
+}
+
+// the content of a tag as nodes, synthesized from the text around its
+// children unless the parser keeps nodes
+func (p *Parser) contentNodes(tag *Tag) []*Node {
+	if p.nodes {
+		return tag.Nodes
+	}
+
+	nodes := make([]*Node, 0, 2*len(tag.Children)+1)
+	offset := tag.Body.Start
+
+	for _, child := range tag.Children {
+		nodes = p.textNodes(nodes, tag, offset, child.Tag.Start)
+		nodes = append(nodes, &Node{Type: ElementNode, Tag: child, Offset: child.Tag, Data: child.Body, parent: tag})
+		offset = child.Tag.End
+	}
+
+	return p.textNodes(nodes, tag, offset, p.bodyEnd(tag))
+}
+
+// the root is left open at the end of the document
+func (p *Parser) bodyEnd(tag *Tag) int {
+	if tag.parent == nil && tag.Body.End == -1 {
+		return p.length
+	}
+
+	return tag.Body.End
+}
+
+// splits the text between two children into text, comment, cdata and
+// processing instruction nodes
+func (p *Parser) textNodes(nodes []*Node, tag *Tag, start, end int) []*Node {
+	if _, rawText := p.rawText(tag); rawText {
+		return p.appendText(nodes, tag, start, end)
+	}
+
+	text := start
+
+	for index := start; index < end; index++ {
+		if (*p.body)[index] != '<' {
+			continue
+		}
+
+		nodeType, sectionEnd, data := p.consumeNode(index)
+
+		if sectionEnd == -1 {
+			continue
+		}
+
+		sectionEnd = min(sectionEnd, end)
+		nodes = p.appendText(nodes, tag, text, index)
+		nodes = append(nodes, &Node{Type: nodeType, Offset: Offset{index, sectionEnd}, Data: data, parent: tag})
+		text = sectionEnd
+		index = sectionEnd - 1
+	}
+
+	return p.appendText(nodes, tag, text, end)
+}
+
+func (p *Parser) appendText(nodes []*Node, tag *Tag, start, end int) []*Node {
+	if start >= end {
+		return nodes
+	}
+
+	offset := Offset{start, end}
+
+	return append(nodes, &Node{Type: TextNode, Offset: offset, Data: offset, parent: tag})
+}
+
+// the target of a processing instruction and the data following it
+func (p *Parser) instruction(data Offset) (string, Offset) {
+	index := data.Start
+
+	for index < data.End && !p.isWhitespace(index) {
+		index++
+	}
+
+	target := p.value(data.Start, index)
+
+	for index < data.End && p.isWhitespace(index) {
+		index++
+	}
+
+	return target, Offset{index, data.End}
+}
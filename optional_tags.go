@@ -0,0 +1,114 @@
+package parseur
+
+var paragraphClosers = map[string]struct{}{
+	"address": {}, "article": {}, "aside": {}, "blockquote": {}, "center": {},
+	"dd": {}, "details": {}, "dialog": {}, "dir": {}, "div": {}, "dl": {},
+	"dt": {}, "fieldset": {}, "figcaption": {}, "figure": {}, "footer": {},
+	"form": {}, "h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+	"header": {}, "hgroup": {}, "hr": {}, "li": {}, "listing": {}, "main": {},
+	"menu": {}, "nav": {}, "ol": {}, "p": {}, "plaintext": {}, "pre": {},
+	"search": {}, "section": {}, "summary": {}, "table": {}, "ul": {},
+	"xmp": {},
+}
+
+var cellClosers = map[string]struct{}{
+	"td": {}, "th": {}, "tr": {}, "tbody": {}, "thead": {}, "tfoot": {},
+}
+
+// start tags that implicitly close the element currently being parsed
+var impliedEndTagsMap = map[string]map[string]struct{}{
+	"p":        paragraphClosers,
+	"li":       {"li": {}},
+	"dt":       {"dt": {}, "dd": {}},
+	"dd":       {"dt": {}, "dd": {}},
+	"rt":       {"rt": {}, "rp": {}},
+	"rp":       {"rt": {}, "rp": {}},
+	"optgroup": {"optgroup": {}, "hr": {}},
+	"option":   {"option": {}, "optgroup": {}, "hr": {}},
+	"colgroup": {"colgroup": {}, "caption": {}, "thead": {}, "tbody": {}, "tfoot": {}, "tr": {}},
+	"td":       cellClosers,
+	"th":       cellClosers,
+	"tr":       {"tr": {}, "tbody": {}, "thead": {}, "tfoot": {}},
+	"thead":    {"tbody": {}, "tfoot": {}},
+	"tbody":    {"tbody": {}, "tfoot": {}},
+	"tfoot":    {"tbody": {}},
+	"head":     {"body": {}},
+	"html":     {},
+	"body":     {},
+}
+
+// a paragraph inside one of these is not closed by its parent's end tag,
+// every other element is closed by the end tag of any open ancestor
+var transparentParentsMap = map[string]struct{}{
+	"a":        {},
+	"audio":    {},
+	"del":      {},
+	"ins":      {},
+	"map":      {},
+	"noscript": {},
+	"video":    {},
+}
+
+func (p *Parser) closesImplicitly(self *Tag, index int) bool {
+	if p.xml || !p.InBound(index+1) {
+		return false
+	}
+
+	if (*p.body)[index+1] != '/' {
+		closers, ok := impliedEndTagsMap[self.Name]
+
+		if ok {
+			_, ok = closers[p.peekTagName(index+1)]
+		}
+
+		return ok
+	}
+
+	name := p.peekTagName(index + 2)
+	depth := len(p.openTags) - 1
+
+	if depth < 1 || name == "" {
+		return false
+	}
+
+	if _, ok := transparentParentsMap[p.openTags[depth-1].Name]; ok && self.Name == "p" {
+		return false
+	}
+
+	for i := depth - 1; i >= 0; i-- {
+		if p.openTags[i].qualifiedName() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) closesAtEnd(self *Tag) bool {
+	if p.xml || len(p.openTags) == 0 {
+		return false
+	}
+
+	_, ok := impliedEndTagsMap[self.Name]
+
+	return ok
+}
+
+func (p *Parser) peekTagName(index int) string {
+	if !p.ffLetter(index) {
+		return ""
+	}
+
+	currentIndex := index + 1
+
+	for p.InBound(currentIndex) && p.isValidTagChar(currentIndex) {
+		currentIndex++
+	}
+
+	if p.InBound(currentIndex) && (*p.body)[currentIndex] == ':' && p.ffLetter(currentIndex+1) {
+		for currentIndex += 1; p.InBound(currentIndex) && p.isValidTagChar(currentIndex); currentIndex++ {
+		}
+	}
+
+	return p.normalizeName(string((*p.body)[index:currentIndex]))
+}
@@ -2,14 +2,13 @@ package parseur
 
 import (
 	"bytes"
+	"html"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 )
 
-var scriptBytes = []byte{
-	0x3c, 0x2f, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74,
-}
-
 const (
 	FAILED  = -1
 	PARSING = 0
@@ -22,6 +21,7 @@ var selfclosingTagsMap = map[string]struct{}{
 	"input":  {},
 	"source": {},
 	"hr":     {},
+	"img":    {},
 	"track":  {},
 	"wbr":    {},
 	"param":  {},
@@ -31,16 +31,43 @@ var selfclosingTagsMap = map[string]struct{}{
 	"area":   {},
 }
 
+// elements whose body is captured verbatim, the value marks bodies in
+// which character references are still decoded
+var rawTextTagsMap = map[string]bool{
+	"script":    false,
+	"style":     false,
+	"xmp":       false,
+	"iframe":    false,
+	"noembed":   false,
+	"noframes":  false,
+	"noscript":  false,
+	"plaintext": false,
+	"textarea":  true,
+	"title":     true,
+}
+
 type Offset struct {
 	Start int
 	End   int
 }
 
+type Options struct {
+	Async       bool
+	Hook        *func(p *Parser)
+	RawEntities bool
+	Nodes       bool
+	// read size for NewStreamParser
+	ChunkSize int
+}
+
 type Parser struct {
 	length        int
 	lastIndex     int
 	html          bool
+	xml           bool
 	runAsync      bool
+	rawEntities   bool
+	nodes         bool
 	Done          bool
 	root          *Tag
 	ffLiteral     func(int) (int, *string)
@@ -53,6 +80,12 @@ type Parser struct {
 	ParseComplete chan struct{}
 	offsetMap     map[int]*Tag
 	namespaces    map[string]string
+	errors        []*ParseError
+	reported      map[parseErrorKey]struct{}
+	lines         []int
+	indexed       int
+	prefixes      map[string]string
+	openTags      []*Tag
 	tagMap        map[string]*[]*Tag
 	InBound       func(int) bool
 	GetOffsetList func() []*Tag
@@ -61,9 +94,11 @@ type Parser struct {
 }
 
 func (p *Parser) First(name string) *Tag {
-	for _, tag := range p.offsetMap {
-		if tag.Name == name {
-			return tag
+	if list, ok := p.tagMap["*"]; ok {
+		for _, tag := range *list {
+			if tag.Name == name {
+				return tag
+			}
 		}
 	}
 
@@ -73,15 +108,46 @@ func (p *Parser) First(name string) *Tag {
 func (p *Parser) Filter(name string) []*Tag {
 	tags := make([]*Tag, 0)
 
-	for _, tag := range p.offsetMap {
-		if tag.Name == name {
-			tags = append(tags, tag)
+	if list, ok := p.tagMap["*"]; ok {
+		for _, tag := range *list {
+			if tag.Name == name {
+				tags = append(tags, tag)
+			}
 		}
 	}
 
 	return tags
 }
 
+// the last tag of that name in document order
+func (p *Parser) Last(name string) *Tag {
+	if list, ok := p.tagMap["*"]; ok {
+		for i := len(*list) - 1; i >= 0; i-- {
+			if (*list)[i].Name == name {
+				return (*list)[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// the tags of Filter in reverse document order
+func (p *Parser) FilterReverse(name string) []*Tag {
+	tags := p.Filter(name)
+	slices.Reverse(tags)
+
+	return tags
+}
+
+// the tags of GetOffsetList in reverse document order
+func (p *Parser) GetReverseOffsetList() []*Tag {
+	tags := slices.Clone(p.GetOffsetList())
+	slices.Reverse(tags)
+
+	return tags
+}
+
 func (p *Parser) GetText() string {
 	builder := strings.Builder{}
 	var reduce func(*Tag) = nil
@@ -93,7 +159,7 @@ func (p *Parser) GetText() string {
 			length := child.Tag.Start - offset
 
 			if length > 0 {
-				builder.Write(p.GetBody()[offset : offset+length])
+				builder.WriteString(p.text(tag, offset, offset+length))
 			}
 
 			reduce(child)
@@ -102,7 +168,7 @@ func (p *Parser) GetText() string {
 		}
 
 		if offset < tag.Body.End {
-			builder.Write(p.GetBody()[offset:tag.Body.End])
+			builder.WriteString(p.text(tag, offset, tag.Body.End))
 		}
 	}
 
@@ -119,6 +185,93 @@ func (p *Parser) value(start, end int) string {
 	return string((*p.body)[start:end])
 }
 
+func (p *Parser) text(tag *Tag, start, end int) string {
+	escapable, ok := p.rawText(tag)
+
+	if ok && escapable {
+		return p.unescape(p.value(start, end))
+	}
+
+	if ok {
+		return p.value(start, end)
+	}
+
+	if !p.xml && !p.foreign(tag) {
+		return p.unescape(p.value(start, end))
+	}
+
+	builder := strings.Builder{}
+
+	// the content of a cdata section is taken as it is
+	for start < end {
+		section := bytes.Index((*p.body)[start:end], []byte("<![CDATA["))
+
+		if section == -1 {
+			section = end - start
+		}
+
+		builder.WriteString(p.unescape(p.value(start, start+section)))
+		start += section
+
+		if start >= end {
+			break
+		}
+
+		close := bytes.Index((*p.body)[start+9:end], []byte("]]>"))
+		sectionEnd := end
+
+		if close != -1 {
+			sectionEnd = start + 9 + close + 3
+		}
+
+		data := p.sectionData(start, sectionEnd, 9, "]]>")
+		builder.WriteString(p.value(data.Start, data.End))
+		start = sectionEnd
+	}
+
+	return builder.String()
+}
+
+func (p *Parser) unescape(text string) string {
+	if p.rawEntities {
+		return text
+	}
+
+	return html.UnescapeString(text)
+}
+
+// raw text elements only exist in html, a prefixed or xml element of the
+// same name is parsed like any other
+func (p *Parser) rawText(tag *Tag) (bool, bool) {
+	if p.xml || tag.Namespace != "" {
+		return false, false
+	}
+
+	escapable, ok := rawTextTagsMap[tag.Name]
+
+	return escapable, ok
+}
+
+// svg, math and prefixed elements hold foreign content, the only place
+// besides xml where html knows cdata sections
+func (p *Parser) foreign(tag *Tag) bool {
+	for ; tag != nil; tag = tag.parent {
+		if tag.Namespace != "" || tag.Name == "svg" || tag.Name == "math" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) attributeValue(value string) string {
+	if p.rawEntities {
+		return value
+	}
+
+	return unescapeAttribute(value)
+}
+
 func MapFromTerms(text string) *map[string]struct{} {
 	m := make(map[string]struct{})
 	length := len(text)
@@ -151,7 +304,7 @@ func (p *Parser) GetJoinedText(separator byte) string {
 			length := child.Tag.Start - offset
 
 			if length > 0 {
-				builder.Write(p.GetBody()[offset : offset+length])
+				builder.WriteString(p.text(tag, offset, offset+length))
 				builder.WriteByte(separator)
 			}
 
@@ -161,7 +314,7 @@ func (p *Parser) GetJoinedText(separator byte) string {
 		}
 
 		if offset < tag.Body.End {
-			builder.Write(p.GetBody()[offset:tag.Body.End])
+			builder.WriteString(p.text(tag, offset, tag.Body.End))
 			builder.WriteByte(separator)
 		}
 	}
@@ -175,20 +328,26 @@ func (p *Parser) sync(index int) bool {
 	return p.length > index
 }
 
+// blocks until the data reaches index, the body is complete once the
+// producer closes DataChan or sends it with Complete set
 func (p *Parser) async(index int) bool {
-	if *p.Complete {
-		p.InBound = p.sync
-
-		return p.InBound(index)
-	} else if p.length > index {
+	if p.length > index {
 		return true
 	}
 
-	p.body = <-p.DataChan
-	p.length = len(*p.body)
+	body, ok := <-p.DataChan
 
-	if p.hook != nil {
-		(*p.hook)(p)
+	if ok {
+		p.body = body
+		p.length = len(*p.body)
+
+		if p.hook != nil {
+			(*p.hook)(p)
+		}
+	}
+
+	if !ok || *p.Complete {
+		p.InBound = p.sync
 	}
 
 	return p.InBound(index)
@@ -211,7 +370,7 @@ func createParser(body *[]byte) *Parser {
 func NewEscapedParser(body *[]byte) *Parser {
 	parser := createParser(body)
 	parser.GetOffsetList = parser.computeOffsetList
-	parser.current = &Tag{Children: make([]*Tag, 0), Name: "root"}
+	parser.current = &Tag{Children: make([]*Tag, 0), Name: "root", parser: parser}
 	parser.lastIndex = 0
 	parser.root = parser.current
 	parser.ffLiteral = parser.ffEscapedTagLiteral
@@ -224,11 +383,17 @@ func NewEscapedParser(body *[]byte) *Parser {
 }
 
 func NewParser(body *[]byte, async bool, hook *func(p *Parser)) *Parser {
+	return NewParserWithOptions(body, Options{Async: async, Hook: hook})
+}
+
+func NewParserWithOptions(body *[]byte, options Options) *Parser {
 	parser := createParser(body)
-	parser.runAsync = async
-	parser.hook = hook
+	parser.runAsync = options.Async
+	parser.hook = options.Hook
+	parser.rawEntities = options.RawEntities
+	parser.nodes = options.Nodes
 	parser.GetOffsetList = parser.computeOffsetList
-	parser.current = &Tag{Children: make([]*Tag, 0), Name: "root"}
+	parser.current = &Tag{Children: make([]*Tag, 0), Name: "root", parser: parser}
 	parser.lastIndex = 0
 	parser.root = parser.current
 
@@ -251,16 +416,20 @@ func NewParser(body *[]byte, async bool, hook *func(p *Parser)) *Parser {
 }
 
 func (p *Parser) parse() {
-	index := p.consumeNamespaceTag(p.skipWhitespace(0))
+	start := p.skipWhitespace(0)
+	index := p.consumeNamespaceTag(start)
 
 	if index == -1 {
 		index = 0
+	} else if (*p.body)[start+1] == '!' {
+		p.addText(p.root, 0, start)
+		p.addNode(p.root, DoctypeNode, start, index, Offset{start + 2, index - 1})
 	}
 
 	_ = p.parseBody(index)
+	p.Done = true
 
 	if p.runAsync {
-		p.Done = true
 		select {
 		case <-p.DataChan:
 		default:
@@ -299,7 +468,7 @@ func (p *Parser) parseDoctype(index int) int {
 		p.namespaceTag = p.current
 	}
 
-	p.html = strings.ToLower(p.current.Name) == "doctype" && p.current.Attributes["html"] == "html"
+	p.html = strings.ToLower(p.current.Name) == "doctype" && p.current.hasAttributeFold("html")
 	p.current = parent
 	return index + 1
 }
@@ -322,17 +491,24 @@ func (p *Parser) consumeNamespaceTag(index int) int {
 
 	currentIndex++
 
+	// any other leading instruction is left for the body
+	if !strings.EqualFold(p.peekTagName(currentIndex), "xml") {
+		return -1
+	}
+
 	currentIndex = p.parseTagName(currentIndex)
+	self := p.current
 	p.current = parent
 
 	if currentIndex == -1 {
 		return -1
 	}
 
-	isNamespaceTag := (*p.body)[currentIndex] == '?' && (*p.body)[currentIndex+1] == '>'
+	isNamespaceTag := p.InBound(currentIndex+1) && (*p.body)[currentIndex] == '?' && (*p.body)[currentIndex+1] == '>'
 
 	if isNamespaceTag {
-		p.namespaceTag = p.current
+		p.namespaceTag = self
+		p.xml = self.Name == "xml"
 	}
 
 	return currentIndex + 2
@@ -369,7 +545,7 @@ func (p *Parser) parseTagEnd(index int, name string) int {
 	length := len(name) + index + 2
 
 	for i, z := 0, index+2; z < length; i, z = i+1, z+1 {
-		notInBoundOrWrongTag := !p.InBound(z) || (*p.body)[z] != name[i]
+		notInBoundOrWrongTag := !p.InBound(z) || p.foldCase((*p.body)[z]) != name[i]
 		if notInBoundOrWrongTag {
 			return -1
 		}
@@ -387,29 +563,11 @@ func (p *Parser) parseTagEnd(index int, name string) int {
 func (p *Parser) retrieveFromCache(index int) (int, bool) {
 	tag, ok := p.offsetMap[index]
 
-	if !ok {
+	if !ok || tag.Tag.End == -1 {
 		return -1, ok
 	}
 
-	currentIndex := index
-
-	if tag.Tag.End == -1 {
-		return -1, ok
-	}
-
-	if _, ok := selfclosingTagsMap[tag.Name]; ok {
-		index = tag.Tag.End
-	} else {
-		index = p.parseTagEnd(tag.Tag.End, tag.Name)
-	}
-
-	currentIndex = p.skipWhitespace(index)
-
-	if currentIndex != -1 {
-		index = currentIndex
-	}
-
-	return index, ok
+	return tag.Tag.End, ok
 }
 
 func (p *Parser) consumeTag(index int) int {
@@ -437,10 +595,16 @@ func (p *Parser) consumeTag(index int) int {
 	self := p.current
 
 	if currentIndex == -1 {
+		if name := p.peekTagName(index + 1); name != "" && p.isTruncated(offset) {
+			p.addError(UnterminatedTag, name, offset)
+		}
+
 		p.current = parent
 		return -1
 	}
 
+	self.Tag.Start = offset
+
 	isEndOfTag := p.InBound(currentIndex+1) && (*p.body)[currentIndex] == '/' && (*p.body)[currentIndex+1] == '>'
 	index = currentIndex
 
@@ -455,22 +619,40 @@ func (p *Parser) consumeTag(index int) int {
 		currentIndex += 2
 	} else if (*p.body)[currentIndex] == '>' {
 		index = currentIndex
-		if self.Name == "script" {
-			currentIndex = p.ffScriptBody(currentIndex)
+		if _, ok := p.rawText(self); ok {
+			// kept when the body turns out to be unterminated
+			self.Body.Start = currentIndex + 1
+			currentIndex = p.ffRawTextBody(currentIndex, self.Name)
 		} else {
+			p.openTags = append(p.openTags, self)
 			currentIndex = p.parseRegularBody(currentIndex)
+			p.openTags = p.openTags[:len(p.openTags)-1]
 		}
 
 	} else {
+		p.current = parent
 		return -1
 	}
 
 	parent.Children = append(parent.Children, self)
+	self.parent = parent
 
 	if currentIndex == -1 {
+		if _, ok := p.rawText(self); ok {
+			p.addError(UnterminatedRawText, self.qualifiedName(), offset)
+		} else {
+			p.addError(UnclosedTag, self.qualifiedName(), offset)
+		}
+
 		self.Body.End = -1
 		currentIndex = index + 1
 
+		for _, child := range self.Children {
+			child.parent = parent
+		}
+
+		self.Nodes = nil
+
 		if len(self.Children) > 0 {
 			parent.Children = append(parent.Children, self.Children...)
 		}
@@ -483,24 +665,60 @@ func (p *Parser) consumeTag(index int) int {
 	p.offsetMap[offset] = self
 	p.addTag(self.Name, self)
 	p.addTag("*", self)
+	p.indexAttributes(self)
 	p.current = parent
 
 	return currentIndex
 }
 
+// tags are registered once closed, so a parent follows its children and has
+// to be inserted in front of them to keep each list in document order
 func (p *Parser) addTag(id string, item *Tag) {
-	if _, ok := p.tagMap[id]; ok {
-		*p.tagMap[id] = append(*p.tagMap[id], item)
-	} else {
-		list := []*Tag{item}
-		p.tagMap[id] = &list
+	list, ok := p.tagMap[id]
+
+	if !ok {
+		p.tagMap[id] = &[]*Tag{item}
+		return
 	}
+
+	i := len(*list)
+
+	for i > 0 && (*list)[i-1].Tag.Start > item.Tag.Start {
+		i--
+	}
+
+	*list = append(*list, nil)
+	copy((*list)[i+1:], (*list)[i:])
+	(*list)[i] = item
+}
+
+func (p *Parser) indexAttributes(tag *Tag) {
+	if attr, ok := tag.Attributes["class"]; ok {
+		p.addClasses(attr, tag)
+	}
+
+	if attr, ok := tag.Attributes["id"]; ok {
+		p.addId(attr, tag)
+	}
+}
+
+// whether the tag starting at index runs into the end of the input
+func (p *Parser) isTruncated(index int) bool {
+	for p.InBound(index) && (*p.body)[index] != '>' {
+		index++
+	}
+
+	return !p.InBound(index)
 }
 
 func (p *Parser) handleSelfclosing(index int) int {
 	currentIndex := index
 	currentIndex = p.skipWhitespace(currentIndex)
 
+	if currentIndex == -1 || !p.InBound(currentIndex) {
+		return -1
+	}
+
 	if (*p.body)[currentIndex] == '>' {
 		return currentIndex + 1
 	}
@@ -515,22 +733,35 @@ func (p *Parser) handleSelfclosing(index int) int {
 	return -1
 }
 
-func (p *Parser) ffScriptBody(index int) int {
+func (p *Parser) ffRawTextBody(index int, name string) int {
 	start := index
+	length := len(name) + 2
+
+	if name == "plaintext" {
+		for p.InBound(index + 1) {
+			index++
+		}
+
+		p.current.Body = Offset{start + 1, index + 1}
+		p.addText(p.current, start+1, index+1)
+
+		return index + 1
+	}
 
 	for index > -1 && p.InBound(index) {
 		for p.InBound(index) && (*p.body)[index] != '<' {
 			index++
 		}
 
-		if !p.InBound(index + 9) {
+		if !p.InBound(index + length) {
 			return -1
 		}
 
-		isScriptEnd := bytes.Equal((*p.body)[index:index+8], scriptBytes)
+		isRawTextEnd := (*p.body)[index+1] == '/' &&
+			bytes.EqualFold((*p.body)[index+2:index+length], []byte(name))
 
-		if isScriptEnd {
-			k := p.skipWhitespace(index + 8)
+		if isRawTextEnd {
+			k := p.skipWhitespace(index + length)
 
 			if k == -1 || (*p.body)[k] != '>' {
 				index += 1
@@ -538,6 +769,7 @@ func (p *Parser) ffScriptBody(index int) int {
 			}
 
 			p.current.Body = Offset{start + 1, index}
+			p.addText(p.current, start+1, index)
 
 			return k + 1
 		}
@@ -549,20 +781,7 @@ func (p *Parser) ffScriptBody(index int) int {
 }
 
 func (p *Parser) parseRegularBody(index int) int {
-	currentIndex := p.parseBody(index + 1)
-
-	if currentIndex == -1 {
-		return -1
-	}
-
-	index = currentIndex
-	currentIndex = p.skipWhitespace(currentIndex)
-
-	if currentIndex == -1 {
-		return index
-	}
-
-	return currentIndex
+	return p.parseBody(index + 1)
 }
 
 func (p *Parser) parseTagName(index int) int {
@@ -580,15 +799,23 @@ func (p *Parser) parseTagName(index int) int {
 		index, value = p.skipValidTag(currentIndex)
 	}
 
-	current := &Tag{}
+	if !p.InBound(index) {
+		return -1
+	}
+
+	current := &Tag{parser: p}
 
 	if (*p.body)[index] == ':' {
-		current.Namespace = *value
+		current.Namespace = p.normalizeName(*value)
 		currentIndex = index + 1
 		index, value = p.skipValidTag(index + 1)
+
+		if index == -1 || !p.InBound(index) {
+			return -1
+		}
 	}
 
-	current.Name = *value
+	current.Name = p.normalizeName(*value)
 	p.current = current
 	current.Attributes = make(map[string]string)
 	currentIndex = p.skipWhitespace(index)
@@ -607,6 +834,7 @@ func (p *Parser) parseBody(index int) int {
 	}
 
 	offset := index
+	textStart := index
 	currentIndex := index
 	self := p.current
 
@@ -617,28 +845,62 @@ func (p *Parser) parseBody(index int) int {
 		}
 
 		currentIndex = index
-		index = p.consumeComment(index)
+		nodeType, end, data := p.consumeNode(index)
 
-		if index != -1 {
+		if end != -1 {
+			p.addText(self, textStart, currentIndex)
+			p.addNode(self, nodeType, currentIndex, end, data)
+			index = end
+			textStart = index
 			continue
 		}
 
-		index = p.parseTagEnd(currentIndex, self.Name)
+		index = p.parseTagEnd(currentIndex, self.qualifiedName())
 
 		if index != -1 {
+			p.addText(self, textStart, currentIndex)
 			self.addOffsets(offset, currentIndex)
 			return index
 		}
 
+		if p.closesImplicitly(self, currentIndex) {
+			if _, ok := impliedEndTagsMap[self.Name]; !ok {
+				p.addError(UnclosedTag, self.qualifiedName(), self.Tag.Start)
+			}
+
+			p.addText(self, textStart, currentIndex)
+			self.addOffsets(offset, currentIndex)
+			return currentIndex
+		}
+
 		index = p.consumeTag(currentIndex)
 
 		if index != -1 {
+			if child, ok := p.offsetMap[currentIndex]; ok && p.nodes {
+				p.addText(self, textStart, currentIndex)
+				p.addElement(self, child)
+				textStart = index
+			}
+
 			continue
 		}
 
+		if p.InBound(currentIndex+1) && (*p.body)[currentIndex+1] == '/' {
+			if name := p.peekTagName(currentIndex + 2); name != "" {
+				p.addError(UnexpectedEndTag, name, currentIndex)
+			}
+		}
+
 		index = currentIndex + 1
 	}
 
+	p.addText(self, textStart, p.length)
+
+	if p.closesAtEnd(self) {
+		self.addOffsets(offset, p.length)
+		return p.length
+	}
+
 	self.addOffsets(offset, -1)
 
 	return -1
@@ -663,114 +925,243 @@ func (p *Parser) consumeComment(index int) int {
 		return -1
 	}
 
-	terminated := false
+	start := index
 
-	for ; p.InBound(index+1) && !terminated; index++ {
-		terminated =
+	for index += 2; p.InBound(index + 2); index++ {
+		terminated :=
 			(*p.body)[index] == '-' &&
 				(*p.body)[index+1] == '-' &&
 				(*p.body)[index+2] == '>'
+
+		if terminated {
+			return index + 3
+		}
+	}
+
+	p.addError(UnterminatedComment, "", start)
+
+	return index + 2
+}
+
+func (p *Parser) consumeCData(index int) int {
+	if !p.hasPrefix(index, "<![CDATA[") {
+		return -1
 	}
 
+	start := index
+
+	for index += 9; p.InBound(index); index++ {
+		if p.hasPrefix(index, "]]>") {
+			return index + 3
+		}
+	}
+
+	p.addError(UnterminatedCData, "", start)
+
 	return index
+}
 
+// html reads a processing instruction as a bogus comment ending with the
+// first '>', in xml it ends with '?>' or with the first '>' if there is none
+func (p *Parser) consumeProcessingInstruction(index int) int {
+	if !p.hasPrefix(index, "<?") || !p.InBound(index+2) || !p.isValidTagStart(index+2) {
+		return -1
+	}
+
+	end := -1
+
+	for index += 2; p.InBound(index); index++ {
+		if (*p.body)[index] != '>' {
+			continue
+		}
+
+		if !p.xml || (*p.body)[index-1] == '?' {
+			return index + 1
+		}
+
+		if end == -1 {
+			end = index + 1
+		}
+	}
+
+	return end
+}
+
+// comments, cdata sections and processing instructions, the markup in
+// them is never parsed
+func (p *Parser) consumeNode(index int) (NodeType, int, Offset) {
+	if end := p.consumeComment(index); end != -1 {
+		return CommentNode, end, p.commentData(index, end)
+	}
+
+	if end := p.consumeCData(index); end != -1 {
+		return CDataNode, end, p.sectionData(index, end, 9, "]]>")
+	}
+
+	if end := p.consumeProcessingInstruction(index); end != -1 {
+		return ProcessingInstructionNode, end, p.sectionData(index, end, 2, "?>")
+	}
+
+	return TextNode, -1, Offset{}
+}
+
+func (p *Parser) hasPrefix(index int, prefix string) bool {
+	if !p.InBound(index + len(prefix) - 1) {
+		return false
+	}
+
+	return string((*p.body)[index:index+len(prefix)]) == prefix
 }
 
 func (p *Parser) parseAttributes(index int) int {
 	currentIndex := index
 
-	if p.InBound(currentIndex+1) &&
-		(*p.body)[currentIndex] == '/' &&
-		(*p.body)[currentIndex+1] == '>' {
-		return currentIndex
-	}
+	for {
+		currentIndex = p.skipWhitespace(currentIndex)
+
+		if currentIndex == -1 || !p.InBound(currentIndex) {
+			return -1
+		}
+
+		if p.isAttributesEnd(currentIndex) {
+			break
+		}
 
-	for currentIndex != -1 {
-		var namespace *string = nil
-		var value *string = nil
+		if (*p.body)[currentIndex] == '/' {
+			currentIndex++
+			continue
+		}
 
+		start := currentIndex
 		c, value := p.ffLiteral(currentIndex)
 
 		if c == -1 {
-			c, value = p.skipValidTag(currentIndex)
+			c, value = p.skipAttributeName(currentIndex)
 		}
 
 		currentIndex = c
 
-		if currentIndex == -1 || !p.InBound(currentIndex) {
+		if currentIndex == -1 {
+			if p.InBound(start) {
+				p.addError(BadAttribute, string((*p.body)[start]), start)
+			}
+
 			return -1
 		}
 
-		name := *value
-
-		if (*p.body)[currentIndex] == '>' {
-			p.current.Attributes[name] = *value
-			return currentIndex
+		if !p.InBound(currentIndex) {
+			return -1
 		}
 
-		if name == "xmlns" &&
-			(*p.body)[currentIndex] == ':' {
-			index = currentIndex + 1
-			currentIndex, value = p.skipValidTag(currentIndex + 1)
+		name := p.normalizeName(*value)
+		attrValue := name
+		valueIndex := p.skipWhitespace(currentIndex)
+
+		if valueIndex != -1 && p.InBound(valueIndex) && (*p.body)[valueIndex] == '=' {
+			currentIndex, value = p.parseAttributeValue(valueIndex + 1)
 
-			if !p.InBound(currentIndex) {
+			if currentIndex == -1 {
+				p.addError(BadAttribute, name, start)
 				return -1
 			}
 
-			namespace = value
+			attrValue = *value
 		}
 
-		if p.isWhitespace(currentIndex) {
-			p.current.Attributes[name] = *value
-			currentIndex = p.skipWhitespace(currentIndex + 1)
-			continue
+		if prefix, ok := strings.CutPrefix(name, "xmlns:"); ok {
+			p.namespaces[prefix] = attrValue
 		}
 
-		if (*p.body)[currentIndex] != '=' || !p.InBound(currentIndex+1) {
-			return -1
+		if _, ok := p.current.Attributes[name]; !ok {
+			p.current.Attributes[name] = attrValue
+		} else {
+			p.addError(BadAttribute, name, start)
 		}
+	}
 
-		index = currentIndex + 2
+	return currentIndex
+}
 
-		currentIndex, value = p.ffLiteral(currentIndex + 1)
+func (p *Parser) isAttributesEnd(index int) bool {
+	if !p.InBound(index) {
+		return false
+	}
 
-		if currentIndex == -1 {
-			break
-		}
+	if (*p.body)[index] == '>' {
+		return true
+	}
 
-		if namespace != nil {
-			p.namespaces[*namespace] = *value
-		} else {
-			p.current.Attributes[name] = *value
-		}
+	isPair := (*p.body)[index] == '/' || (*p.body)[index] == '?'
 
-		currentIndex = p.skipWhitespace(currentIndex)
-		index = currentIndex
+	return isPair && p.InBound(index+1) && (*p.body)[index+1] == '>'
+}
 
-		if currentIndex == -1 {
-			break
-		}
+func (p *Parser) parseAttributeValue(index int) (int, *string) {
+	currentIndex := p.skipWhitespace(index)
 
-		if (*p.body)[currentIndex] == '>' ||
-			((*p.body)[currentIndex] == '?' && (*p.body)[currentIndex+1] == '>') ||
-			((*p.body)[currentIndex] == '/' && (*p.body)[currentIndex+1] == '>') {
+	if currentIndex == -1 || !p.InBound(currentIndex) {
+		return -1, nil
+	}
 
-			if attr, ok := p.current.Attributes["class"]; ok {
-				p.addClasses(attr)
-			}
+	c, value := p.ffLiteral(currentIndex)
+	isQuoted := (*p.body)[currentIndex] == '"' || (*p.body)[currentIndex] == '\''
 
-			if attr, ok := p.current.Attributes["id"]; ok {
-				p.addId(attr, p.current)
-			}
+	if c == -1 && !isQuoted {
+		c, value = p.skipUnquotedValue(currentIndex)
+	}
 
-			break
-		}
+	if c == -1 {
+		return -1, nil
 	}
 
-	return currentIndex
+	attrValue := p.attributeValue(*value)
+
+	return c, &attrValue
+}
+
+func (p *Parser) skipAttributeName(index int) (int, *string) {
+	currentIndex := index
+
+	for p.InBound(currentIndex) && p.isAttributeNameChar(currentIndex) {
+		currentIndex++
+	}
+
+	if currentIndex == index {
+		return -1, nil
+	}
+
+	attrName := string((*p.body)[index:currentIndex])
+
+	return currentIndex, &attrName
 }
 
-func (p *Parser) addClasses(classes string) {
+func (p *Parser) skipUnquotedValue(index int) (int, *string) {
+	currentIndex := index
+
+	for p.InBound(currentIndex) && !p.isWhitespace(currentIndex) && (*p.body)[currentIndex] != '>' {
+		currentIndex++
+	}
+
+	if !p.InBound(currentIndex) {
+		return -1, nil
+	}
+
+	attrValue := string((*p.body)[index:currentIndex])
+
+	return currentIndex, &attrValue
+}
+
+func (p *Parser) isAttributeNameChar(index int) bool {
+	c := (*p.body)[index]
+
+	if p.isWhitespace(index) || c == '/' || c == '>' || c == '=' {
+		return false
+	}
+
+	return c != '?' || !p.InBound(index+1) || (*p.body)[index+1] != '>'
+}
+
+func (p *Parser) addClasses(classes string, current *Tag) {
 	length := len(classes)
 
 	for i, k := 0, 0; i < length; i++ {
@@ -783,7 +1174,7 @@ func (p *Parser) addClasses(classes string) {
 		}
 
 		id := "." + classes[k:i]
-		p.addTag(id, p.current)
+		p.addTag(id, current)
 	}
 }
 
@@ -882,6 +1273,22 @@ func (p *Parser) skipValidTag(index int) (int, *string) {
 	return currentIndex, &attrValue
 }
 
+func (p *Parser) normalizeName(name string) string {
+	if p.html {
+		return strings.ToLower(name)
+	}
+
+	return name
+}
+
+func (p *Parser) foldCase(c byte) byte {
+	if p.html && 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
 func (p *Parser) isValidTagStart(index int) bool {
 	return ('A' <= (*p.body)[index] && (*p.body)[index] <= 'Z') ||
 		('a' <= (*p.body)[index] && (*p.body)[index] <= 'z')
@@ -901,6 +1308,11 @@ func (p *Parser) computeOffsetList() []*Tag {
 		t = append(t, tag)
 	}
 
+	sort.Slice(t, func(a, b int) bool {
+		return t[a].Tag.Start < t[b].Tag.Start
+	})
+
+	// cached once parsing has finished, until a mutation resets it
 	if p.Done {
 		p.GetOffsetList = func() []*Tag {
 			return t
@@ -913,7 +1325,9 @@ func (p *Parser) computeOffsetList() []*Tag {
 func (p *Parser) addId(value string, current *Tag) {
 	queryHandle := "#" + value
 
-	if _, ok := p.tagMap[queryHandle]; !ok {
+	if tags, ok := p.tagMap[queryHandle]; !ok {
 		p.addTag(queryHandle, current)
+	} else if (*tags)[0].Tag.Start > current.Tag.Start {
+		(*tags)[0] = current
 	}
 }
@@ -1,10 +1,17 @@
 package parseur
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func init() {
@@ -45,19 +52,17 @@ func Test_Multiline(t *testing.T) {
 }
 
 func Test_QualifierSort(t *testing.T) {
-	payload := []byte(``)
-	p := NewParser(&payload, false, nil)
-	qualifiers, _ := p.Query(".rofl#a > a").parseQualifiers(0)
+	qualifiers, _, _ := parseQualifiers(".rofl#a > a", 0, 0)
 
-	if len(*qualifiers) != 2 {
+	if len(qualifiers) != 2 {
 		panic("wrong qualifier length")
 	}
 
-	if (*qualifiers)[0] != "#a" {
+	if qualifiers[0].value != "#a" {
 		panic("wrong qualifier order")
 	}
 
-	if (*qualifiers)[1] != ".rofl" {
+	if qualifiers[1].value != ".rofl" {
 		panic("wrong qualifier order")
 	}
 }
@@ -144,8 +149,7 @@ func Test_QueryTag(t *testing.T) {
 func Test_InnerText(t *testing.T) {
 	payload := []byte(`<div class="rofl" id="a">Hi!How are you?<div class="lol">Bye.</div></div>`)
 	p := NewParser(&payload, false, nil)
-	// TODO: order is depth-first
-	text := (*p.Query("div").Get())[1].InnerText()
+	text := (*p.Query("div").Get())[0].InnerText()
 	if text != "Hi!How are you?Bye." {
 		panic("wrong innertext")
 	}
@@ -229,19 +233,51 @@ func Test_UnescapedTag(t *testing.T) {
 }
 
 func Test_Invalid(t *testing.T) {
-	t.Run("handle panic", func(t *testing.T) {
-		defer func() {
-			if recover() == nil {
-				t.Error("Invalid query should panic")
-			}
-		}()
-
+	t.Run("handle invalid query", func(t *testing.T) {
 		tl := []byte(`<a><p></a></p><br/>`)
 		p := NewParser(&tl, false, nil)
-		p.Query("a + b").First()
+		q := p.Query("a $ b")
+
+		if q.First().Exists() || q.Get() != nil {
+			t.Error("Invalid query should match nothing")
+		}
+
+		if err, ok := q.Err().(*SelectorError); !ok || err.Offset != 2 {
+			t.Error("Invalid query should report its error")
+		}
+
+		if q = p.Query("a").Query("> :foo"); q.First().Exists() || q.Err() == nil {
+			t.Error("Invalid sub query should report its error")
+		}
+
+		if p.Query("p").First().Closest("a >").Exists() || p.Query("a").Err() != nil {
+			t.Error("Invalid closest should match nothing")
+		}
 	})
 }
 
+func Test_ChildCombinatorIndex(t *testing.T) {
+	// a child combinator must not overwrite the tag index it starts from
+	payload := []byte(`<ul><li>a</li><li><ol><li>b</li></ol></li></ul><li>c</li>`)
+	p := NewParser(&payload, false, nil)
+
+	if children := p.Query("ul > li").Get(); children == nil || len(*children) != 2 {
+		log.Fatal("wrong child combinator result")
+	}
+
+	if lists := p.GetTags("ul"); len(*lists) != 1 || (*lists)[0].Name != "ul" {
+		log.Fatal("tag index changed by a child combinator")
+	}
+
+	if items := p.Query("li").Get(); items == nil || len(*items) != 4 || len(*p.GetTags("li")) != 4 {
+		log.Fatal("tag index changed by a child combinator")
+	}
+
+	if children := p.Query("ol > li").Get(); children == nil || len(*children) != 1 || (*children)[0].InnerText() != "b" {
+		log.Fatal("wrong child combinator result after a previous query")
+	}
+}
+
 func Test_Query(t *testing.T) {
 	payload := []byte(`<div class="rofl">Hi!</div>How are you?<div class="lol">Bye.</div><span class="rofl"></span>`)
 
@@ -292,6 +328,15 @@ func Test_Bounds(t *testing.T) {
 	if tag.OuterText() != "<div />" {
 		log.Fatal("tag offset wrong")
 	}
+
+	payload = "<div><b>x</b> \n <i>y</i>\n</div>"
+	body = []byte(payload)
+
+	tag = NewParser(&body, false, nil).Query("b").First()
+
+	if tag.OuterText() != "<b>x</b>" {
+		log.Fatal("whitespace after an end tag should not belong to the tag")
+	}
 }
 
 func Test_Body(t *testing.T) {
@@ -323,6 +368,25 @@ func Test_Body(t *testing.T) {
 	}
 }
 
+func Test_VoidElements(t *testing.T) {
+	// img has no end tag and must not swallow its siblings
+	body := []byte(`<p><img src=a.png>text<span>b</span><img src=b.png /></p>`)
+	p := NewParser(&body, false, nil)
+	img := p.Query("img").First()
+
+	if img.OuterText() != "<img src=a.png>" || len(img.Children) != 0 || img.Body.End != 0 {
+		log.Fatal("img not parsed as a void element")
+	}
+
+	if !p.Query("p > span").First().Exists() || len(*p.Query("p > img").Get()) != 2 {
+		log.Fatal("siblings of img nested inside it")
+	}
+
+	if p.Query("p").First().InnerText() != "textb" {
+		log.Fatal("wrong text around img")
+	}
+}
+
 func Test_Classes(t *testing.T) {
 	check := func(tags *[]*Tag, tag *Tag, ok bool) {
 		if !ok {
@@ -340,7 +404,7 @@ func Test_Classes(t *testing.T) {
 
 	current := Tag{Attributes: map[string]string{"class": "a rofl lol rofl"}}
 	parser := Parser{length: 12, tagMap: map[string]*[]*Tag{}, current: &current}
-	parser.addClasses(current.Attributes["class"])
+	parser.addClasses(current.Attributes["class"], &current)
 	tags, ok := parser.tagMap[".a"]
 	check(tags, &current, ok)
 
@@ -551,3 +615,1368 @@ func Test_RequestHeaders(t *testing.T) {
 	}
 
 }
+
+func Test_Entities(t *testing.T) {
+	data := []byte(`<div title="Tom &amp; Jerry" href="?a=1&copy=2&lang=en">&lt;b&gt; &#x27;quoted&#39; &copy 2024&nbsp;&notanentity;</div>`)
+	c := NewParser(&data, false, nil)
+	div := c.Query("div").First()
+
+	if div.Attributes["title"] != "Tom & Jerry" {
+		log.Fatal("attribute entity not decoded")
+	}
+
+	if div.Attributes["href"] != "?a=1&copy=2&lang=en" {
+		log.Fatal("legacy reference in attribute should be kept verbatim")
+	}
+
+	if div.InnerText() != "<b> 'quoted' © 2024 ¬anentity;" {
+		log.Fatal("text entities not decoded")
+	}
+
+	if c.GetText() != div.InnerText() {
+		log.Fatal("extracted text doesnt match")
+	}
+
+	c = NewParserWithOptions(&data, Options{RawEntities: true})
+	div = c.Query("div").First()
+
+	if div.Attributes["title"] != "Tom &amp; Jerry" || div.InnerText() != "&lt;b&gt; &#x27;quoted&#39; &copy 2024&nbsp;&notanentity;" {
+		log.Fatal("raw values should not be decoded")
+	}
+}
+
+func Test_ImpliedEndTags(t *testing.T) {
+	data := []byte(`<ul><li>a<li>b</ul><p>one<p>two<div>three</div>`)
+	c := NewParser(&data, false, nil)
+	ul := c.Query("ul").First()
+
+	if len(ul.Children) != 2 || ul.Body.End == -1 {
+		log.Fatal("list items should be closed implicitly")
+	}
+
+	items := *c.Query("ul > li").Get()
+
+	if items[0].InnerText() != "a" || items[1].InnerText() != "b" {
+		log.Fatal("wrong list item text")
+	}
+
+	paragraphs := *c.Query("p").Get()
+
+	if len(paragraphs) != 2 || paragraphs[0].OuterText() != "<p>one" || paragraphs[1].OuterText() != "<p>two" {
+		log.Fatal("paragraphs should be closed implicitly")
+	}
+
+	if len(c.GetRoot().Children) != 4 {
+		log.Fatal("wrong number of top level elements")
+	}
+
+	data = []byte(`<p>a<li>b<p>c<dl><dt>d<p>e<dd>f</dl><p>g<center>h</center><p>i<summary>j</summary>`)
+	c = NewParser(&data, false, nil)
+
+	for _, p := range *c.Query("p").Get() {
+		if len(p.Children) != 0 {
+			log.Fatalf("paragraph %s should be closed implicitly", p.OuterText())
+		}
+	}
+
+	if len(*c.Query("li, dl, dt, dd, center, summary").Get()) != 6 || c.Query("p li, p dd, p center, p summary").First().Exists() {
+		log.Fatal("elements closing paragraphs nested inside them")
+	}
+
+	data = []byte(`<table><tr><td>1<td>2<tr><th>3</table>`)
+	c = NewParser(&data, false, nil)
+
+	if len(*c.Query("table > tr").Get()) != 2 || len(*c.Query("tr > td").Get()) != 2 {
+		log.Fatal("table rows and cells should be closed implicitly")
+	}
+
+	if c.Query("th").First().InnerText() != "3" || c.Query("table").First().Body.End == -1 {
+		log.Fatal("table should be closed")
+	}
+
+	data = []byte(`<?xml version="1.0"?><p>one<p>two</p></p>`)
+	c = NewParser(&data, false, nil)
+
+	if len(*c.Query("p > p").Get()) != 1 {
+		log.Fatal("xml documents should not imply end tags")
+	}
+}
+
+func Test_RawTextElements(t *testing.T) {
+	data := []byte(`<head><title>a &amp; <b></title><style>p > a { content: "<div>" }</style><script>if (a < b) {}</SCRIPT></head><textarea><p>&lt;x&gt;</textarea><plaintext><a>`)
+	c := NewParser(&data, false, nil)
+
+	if c.Query("b").First().Exists() || c.Query("div").First().Exists() || c.Query("p").First().Exists() {
+		log.Fatal("raw text bodies should not be parsed as markup")
+	}
+
+	if c.Query("title").First().InnerText() != "a & <b>" {
+		log.Fatal("wrong title text")
+	}
+
+	if c.Query("style").First().InnerText() != `p > a { content: "<div>" }` {
+		log.Fatal("wrong style text")
+	}
+
+	if c.Query("script").First().InnerText() != "if (a < b) {}" {
+		log.Fatal("wrong script text")
+	}
+
+	if c.Query("textarea").First().InnerText() != "<p><x>" {
+		log.Fatal("wrong textarea text")
+	}
+
+	plaintext := c.Query("plaintext").First()
+
+	if plaintext.InnerText() != "<a>" || plaintext.Tag.Tag.End != len(data) || c.Query("a").First().Exists() {
+		log.Fatal("plaintext should extend to the end of the document")
+	}
+}
+
+func Test_CaseInsensitiveTags(t *testing.T) {
+	data := []byte(`<!DOCTYPE HTML><DIV Class="a">x<BR>y<Span>z</SPAN></div>`)
+	c := NewParser(&data, false, nil)
+	div := c.Query("div").First()
+
+	if !div.Exists() || div.Body.End == -1 || div.InnerText() != "xyz" {
+		log.Fatal("tag names should match case-insensitively in html mode")
+	}
+
+	if len(*c.Query("div > br").Get()) != 1 || c.Query("div > span").First().InnerText() != "z" {
+		log.Fatal("tag names should be normalised to lowercase")
+	}
+
+	if div.Attributes["class"] != "a" {
+		log.Fatal("attribute names should be normalised to lowercase")
+	}
+
+	if len(*c.Query("DIV > Br").Get()) != 1 || !c.Query("SPAN").First().Exists() || !c.Select(MustCompile("Div[CLASS=a].a")).First().Exists() {
+		log.Fatal("selectors should match case-insensitively in html mode")
+	}
+
+	data = []byte(`<?xml version="1.0"?><Item Id="a"><item>x</item></Item>`)
+	c = NewParser(&data, false, nil)
+
+	if len(*c.Query("Item").Get()) != 1 || len(*c.Query("item").Get()) != 1 {
+		log.Fatal("xml tag names should stay case-sensitive")
+	}
+
+	if c.Query("ITEM").First().Exists() || c.Query("[id]").First().Exists() || !c.Query("[Id]").First().Exists() {
+		log.Fatal("xml selectors should stay case-sensitive")
+	}
+}
+
+func Test_UnquotedAttributes(t *testing.T) {
+	data := []byte(`<a href=/x/y?a=1&amp;b=2 class=btn disabled data-empty=><input checked/><div :class="{a: b}" @click=go x-on:keyup.enter="send" v_model id=a id=b class="first" class="second"></div>`)
+	c := NewParser(&data, false, nil)
+	a := c.Query("a").First()
+
+	if a.Attributes["href"] != "/x/y?a=1&b=2" || a.Attributes["class"] != "btn" {
+		log.Fatal("unquoted attribute values not parsed correctly")
+	}
+
+	if a.Attributes["data-empty"] != "" || a.Attributes["disabled"] != "disabled" {
+		log.Fatal("valueless attributes not parsed correctly")
+	}
+
+	if c.Query("input").First().Attributes["checked"] != "checked" {
+		log.Fatal("valueless attribute before /> not parsed correctly")
+	}
+
+	div := c.Query("div").First()
+
+	if div.Attributes[":class"] != "{a: b}" || div.Attributes["@click"] != "go" ||
+		div.Attributes["x-on:keyup.enter"] != "send" || div.Attributes["v_model"] != "v_model" {
+		log.Fatal("framework attribute names not parsed correctly")
+	}
+
+	if div.Attributes["id"] != "a" || div.Attributes["class"] != "first" {
+		log.Fatal("first attribute should win")
+	}
+
+	if c.Query(".btn").First().Tag != a.Tag || c.Query("#a").First().Tag != div.Tag {
+		log.Fatal("classes and ids should be indexed")
+	}
+}
+
+func Test_Navigation(t *testing.T) {
+	data := []byte(`<div class="card"><h2>Title</h2><span>a</span><em>b</em><b>c</b></div><section><p>x</section><i>unclosed<u>x</u>`)
+	c := NewParser(&data, false, nil)
+	span := c.Query("span").First()
+
+	if span.Parent().Name != "div" || span.Index() != 1 {
+		log.Fatal("wrong parent or index")
+	}
+
+	if span.PrevSibling().Name != "h2" || span.NextSibling().Name != "em" {
+		log.Fatal("wrong siblings")
+	}
+
+	if c.Query("h2").First().PrevSibling().Exists() || c.Query("b").First().NextSibling().Exists() {
+		log.Fatal("sibling should not exist")
+	}
+
+	if c.Query("b").First().Closest(".card").Tag != c.Query("div").First().Tag {
+		log.Fatal("wrong closest element")
+	}
+
+	if c.Query("b").First().Closest("section").Exists() {
+		log.Fatal("closest element should not exist")
+	}
+
+	ancestors := *c.Query("p").First().Ancestors()
+
+	if len(ancestors) != 2 || ancestors[0].Name != "section" || ancestors[1].Tag != c.GetRoot() {
+		log.Fatal("wrong ancestors")
+	}
+
+	if c.Query("u").First().Parent().Tag != c.GetRoot() {
+		log.Fatal("hoisted children should point to their new parent")
+	}
+
+	if c.Query("u").First().PrevSibling().Name != "i" {
+		log.Fatal("hoisted children should be siblings of the unclosed element")
+	}
+}
+
+func Test_Nodes(t *testing.T) {
+	data := []byte(`<!DOCTYPE html><form><!-- name --><label>Name:</label> Bob <b>x</b></form>`)
+	c := NewParserWithOptions(&data, Options{Nodes: true})
+	root := c.GetRoot()
+
+	if len(root.Nodes) != 2 || root.Nodes[0].Type != DoctypeNode || c.NodeValue(root.Nodes[0]) != "DOCTYPE html" {
+		log.Fatal("doctype node missing")
+	}
+
+	form := c.Query("form").First()
+	types := []NodeType{CommentNode, ElementNode, TextNode, ElementNode}
+
+	if len(form.Nodes) != len(types) {
+		log.Fatal("wrong node count")
+	}
+
+	for i, nodeType := range types {
+		if form.Nodes[i].Type != nodeType {
+			log.Fatal("wrong node type")
+		}
+	}
+
+	if c.NodeValue(form.Nodes[0]) != " name " || form.Nodes[0].Offset != (Offset{21, 34}) {
+		log.Fatal("wrong comment node")
+	}
+
+	label := c.Query("label").First()
+
+	if c.NodeValue(label.NextNode()) != " Bob " || label.NextNode().Next().Tag != c.Query("b").First().Tag {
+		log.Fatal("wrong text node after label")
+	}
+
+	if label.PrevNode().Type != CommentNode || label.PrevNode().Prev() != nil {
+		log.Fatal("wrong node before label")
+	}
+
+	if NewParser(&data, false, nil).Query("form").First().Nodes != nil {
+		log.Fatal("nodes should only be recorded when enabled")
+	}
+}
+
+func Test_AttributeSelectors(t *testing.T) {
+	data := []byte(`<head><meta property="og:title" content="Title"><meta property="og:type" content="video"><meta name="description" content="Desc"></head>
+<a href="/docs/a.pdf" lang="en-US" rel="nofollow noopener" class="x">a</a><a href="https://example.com" lang="EN" data-id>b</a>`)
+	c := NewParser(&data, false, nil)
+
+	if c.Query(`meta[property="og:title"]`).First().Attributes["content"] != "Title" {
+		log.Fatal("wrong element for equality selector")
+	}
+
+	if len(*c.Query("meta[property^='og:']").Get()) != 2 || len(*c.Query("head [content]").Get()) != 3 {
+		log.Fatal("wrong count for prefix or presence selector")
+	}
+
+	cases := map[string]string{
+		`a[href$=".pdf"]`:             "a",
+		`[href*=example]`:             "b",
+		`a[rel~=noopener]`:            "a",
+		`a[lang|=en]`:                 "a",
+		`a[lang="en" i]`:              "b",
+		`[data-id]`:                   "b",
+		`a.x[ href = "/docs/a.pdf" ]`: "a",
+	}
+
+	for query, text := range cases {
+		tags := *c.Query(query).Get()
+
+		if len(tags) != 1 || tags[0].InnerText() != text {
+			log.Fatalf("wrong result for %s", query)
+		}
+	}
+
+	if c.Query(`a[rel~=no]`).Get() != nil || c.Query(`a[href^=""]`).Get() != nil {
+		log.Fatal("selector should not match")
+	}
+}
+
+func Test_StructuralPseudoClasses(t *testing.T) {
+	data := []byte(`<table><tr><td>1</td><td>2</td><td>3</td><th>h</th><td>4</td><td>5</td></tr><tr><td>only</td></tr></table><p></p><p>x</p>`)
+	c := NewParser(&data, false, nil)
+
+	cases := map[string]string{
+		"td:first-child":          "1only",
+		"tr :last-child":          "5only",
+		"td:only-child":           "only",
+		"tr > :nth-child(3)":      "3",
+		"td:nth-child(2n+1)":      "134only",
+		"td:nth-child(odd)":       "134only",
+		"td:nth-child(-n + 2)":    "12only",
+		"td:nth-last-child(2)":    "4",
+		"td:nth-of-type(4)":       "4",
+		"td:first-of-type":        "1only",
+		"th:only-of-type":         "h",
+		"tr:nth-child(even) > td": "only",
+		":root":                   "123h45onlyx",
+	}
+
+	for query, text := range cases {
+		tags := c.Query(query).Get()
+		builder := strings.Builder{}
+
+		if tags != nil {
+			for _, tag := range *tags {
+				builder.WriteString(tag.InnerText())
+			}
+		}
+
+		if builder.String() != text {
+			log.Fatalf("wrong result for %s: %s", query, builder.String())
+		}
+	}
+
+	if len(*c.Query("p:empty").Get()) != 1 || c.Query("td:nth-child(0)").Get() != nil {
+		log.Fatal("wrong result for :empty or :nth-child(0)")
+	}
+}
+
+func Test_LogicalPseudoClasses(t *testing.T) {
+	data := []byte(`<div class="card" id="a"><h2>A</h2><span class="price">1</span></div><div class="card" id="b"><h2>B</h2></div><div class="card sold" id="c"><p><span class="price">3</span></p></div>`)
+	c := NewParser(&data, false, nil)
+
+	cases := map[string]string{
+		".card:has(.price)":              "ac",
+		".card:has(> .price)":            "a",
+		".card:has(h2 + span)":           "a",
+		".card:has(> h2 + .price)":       "a",
+		".card:not(.sold)":               "ab",
+		".card:not(.sold, :has(.price))": "b",
+		":is(#a, #c).card":               "ac",
+		"div:where(.sold, #b)":           "bc",
+		".card:not(:has(span)):is(div)":  "b",
+	}
+
+	for query, ids := range cases {
+		tags := c.Query(query).Get()
+		builder := strings.Builder{}
+
+		if tags != nil {
+			for _, tag := range *tags {
+				builder.WriteString(tag.Attributes["id"])
+			}
+		}
+
+		if builder.String() != ids {
+			log.Fatalf("wrong result for %s: %s", query, builder.String())
+		}
+	}
+
+	if c.Query("h2:has(+ .price)").First().InnerText() != "A" || len(*c.Query("h2:is(div > h2)").Get()) != 2 {
+		log.Fatal("wrong result for relative selector")
+	}
+}
+
+func Test_SiblingCombinators(t *testing.T) {
+	data := []byte(`<ul><li id="a">a</li><li id="b" class="x">b</li><li id="c">c</li><li id="d" class="x">d</li></ul><p id="e"><span id="f">f</span></p><h1 id="g">g</h1>`)
+	c := NewParser(&data, false, nil)
+
+	cases := map[string]string{
+		"#a + li":                      "b",
+		"#a ~ li":                      "bcd",
+		".x + li":                      "c",
+		".x ~ .x":                      "d",
+		"ul > li + li.x":               "bd",
+		"ul + p > span":                "f",
+		"ul ~ h1":                      "g",
+		"h1, #a":                       "ag",
+		"span, p, .x, #b":              "bdef",
+		"li:first-child + li, #c ~ li": "bd",
+	}
+
+	for query, ids := range cases {
+		tags := c.Query(query).Get()
+		builder := strings.Builder{}
+
+		if tags != nil {
+			for _, tag := range *tags {
+				builder.WriteString(tag.Attributes["id"])
+			}
+		}
+
+		if builder.String() != ids {
+			log.Fatalf("wrong result for %s: %s", query, builder.String())
+		}
+	}
+
+	ul := c.Query("ul").First()
+
+	if len(*ul.Query("li + li").Get()) != 3 || ul.Query("h1, span").Get() != nil {
+		log.Fatal("wrong scoped result")
+	}
+
+	if len(*c.Query("ul").Query("> #b ~ li, #a").Get()) != 3 {
+		log.Fatal("wrong chained result")
+	}
+}
+
+func Test_CompiledSelectors(t *testing.T) {
+	errors := map[string]int{
+		"a $ b":           2,
+		"div > ":          6,
+		"li:nth-child(x)": 13,
+		":foo":            0,
+		"a, :not(b $ c)":  10,
+		"[href":           0,
+		"a, , b":          3,
+	}
+
+	for selector, offset := range errors {
+		_, err := Compile(selector)
+		selectorError, ok := err.(*SelectorError)
+
+		if !ok || selectorError.Offset != offset || selectorError.Selector != selector {
+			log.Fatalf("wrong error for %s: %v", selector, err)
+		}
+	}
+
+	selector := MustCompile("li.x, > p")
+	first := []byte(`<ul><li class="x">a</li><li>b</li></ul><p>c</p>`)
+	second := []byte(`<div><p>d</p></div><li class="x">e</li>`)
+	a := NewParser(&first, false, nil)
+	b := NewParser(&second, false, nil)
+
+	if tags := a.Select(selector).Get(); tags == nil || len(*tags) != 2 || (*tags)[1].InnerText() != "c" {
+		log.Fatal("wrong result for first parser")
+	}
+
+	if tags := b.Select(selector).Get(); tags == nil || len(*tags) != 1 || (*tags)[0].InnerText() != "e" {
+		log.Fatal("wrong result for second parser")
+	}
+
+	if div := b.Query("div").First(); div.Select(selector).First().InnerText() != "d" || !selector.Match(a.Query("p").First()) || selector.Match(div.Query("p").First()) {
+		log.Fatal("wrong result for subtree")
+	}
+
+	if selector.Match(a.Query("li").Last()) || selector.String() != "li.x, > p" {
+		log.Fatal("wrong match")
+	}
+
+	defer func() {
+		if recover() == nil {
+			log.Fatal("MustCompile did not panic")
+		}
+	}()
+
+	MustCompile("a >")
+}
+
+func Test_DocumentOrder(t *testing.T) {
+	payload := []byte(`<div id="a" class="x"><div id="b" class="x"><div id="c" class="x"></div></div></div><div id="d" class="x"><p id="a"></p></div>`)
+	p := NewParser(&payload, false, nil)
+
+	ids := func(tags []*Tag) string {
+		builder := strings.Builder{}
+
+		for _, tag := range tags {
+			builder.WriteString(tag.Attributes["id"])
+		}
+
+		return builder.String()
+	}
+
+	queried := func(q *Query) []*Tag {
+		tags := make([]*Tag, 0)
+
+		for _, tag := range *q.Get() {
+			tags = append(tags, tag.Tag)
+		}
+
+		return tags
+	}
+
+	if ids(queried(p.Query("div"))) != "abcd" || ids(queried(p.Query(".x"))) != "abcd" || ids(queried(p.Query("div div"))) != "bc" {
+		log.Fatal("query results not in document order")
+	}
+
+	if ids(queried(p.Query("div").Reverse())) != "dcba" || p.Query(".x").Reverse().First().Attributes["id"] != "d" {
+		log.Fatal("query results not in reverse order")
+	}
+
+	if ids(p.Filter("div")) != "abcd" || p.First("div").Attributes["id"] != "a" || ids(p.GetOffsetList()) != "abcda" {
+		log.Fatal("parser results not in document order")
+	}
+
+	if ids(p.FilterReverse("div")) != "dcba" || p.Last("div").Attributes["id"] != "d" || ids(p.GetReverseOffsetList()) != "adcba" {
+		log.Fatal("parser results not in reverse order")
+	}
+
+	// the sorted list is cached once the document is parsed
+	if !p.Done || &p.GetOffsetList()[0] != &p.GetOffsetList()[0] {
+		log.Fatal("offset list not cached")
+	}
+
+	if p.Query("#a").First().Name != "div" {
+		log.Fatal("id not resolved to the first element")
+	}
+}
+
+func Test_XPath(t *testing.T) {
+	payload := []byte(`<!DOCTYPE html><html><body><table><tr><th>Name</th><td>Foo</td></tr><tr><th>Price</th><td class="v">12.50</td></tr></table><ul><li id="a">one<!-- c --></li><li lang="en-US">two &amp; <b>three</b></li><li>3</li></ul></body></html>`)
+
+	for _, nodes := range []bool{false, true} {
+		p := NewParserWithOptions(&payload, Options{Nodes: nodes})
+
+		cases := map[string]string{
+			"//li[2]":                                "two & three",
+			"//li[last()]":                           "3",
+			"count(//li)":                            "3",
+			"//th[.='Price']/following-sibling::td":  "12.50",
+			"sum(//td[@class]) * 2":                  "25",
+			"//li/@id":                               "a",
+			"//li[1]/comment()":                      " c ",
+			"name(/*)":                               "html",
+			"//li[lang('en')]/b":                     "three",
+			"normalize-space(//li[2])":               "two & three",
+			"substring('12345', 1.5, 2.6)":           "234",
+			"local-name(//b/ancestor::*[2])":         "ul",
+			"//li[3]/preceding::*[1]":                "three",
+			"id('a')":                                "one",
+			"1 div 0":                                "Infinity",
+			"translate('abc', 'abc', 'AB')":          "AB",
+			"2 * 3 - -1 mod 3":                       "7",
+			"//tr[th='Name']/td":                     "Foo",
+			"string(//li[starts-with(@lang, 'en')])": "two & three",
+			"boolean(//li[position() > 3])":          "false",
+		}
+
+		for expr, expected := range cases {
+			result, err := p.XPath(expr)
+
+			if err != nil || result.String() != expected {
+				log.Fatalf("wrong result for %s: %v %v", expr, result, err)
+			}
+		}
+
+		result, _ := p.XPath("//li/text() | //*[@id='a'] | //b")
+
+		if strings.Join(result.Strings(), ",") != "one,one,two & ,three,3" || len(*result.Tags()) != 2 {
+			log.Fatalf("wrong node-set: %q", result.Strings())
+		}
+
+		li := p.Query("li").First()
+
+		if result, _ := li.XPath("../li[2]/b"); result.First().InnerText() != "three" {
+			log.Fatal("wrong result for relative path")
+		}
+
+		if result, _ := li.XPath("//b | text()"); strings.Join(result.Strings(), ",") != "one,three" {
+			log.Fatal("wrong result for absolute path")
+		}
+	}
+
+	p := NewParser(&payload, false, nil)
+	errors := map[string]int{
+		"//li[":        5,
+		"foo(1)":       0,
+		"//li[@id='a]": 9,
+		"a b":          2,
+		"bogus::a":     0,
+	}
+
+	for expr, offset := range errors {
+		_, err := p.XPath(expr)
+
+		if xpathError, ok := err.(*XPathError); !ok || xpathError.Offset != offset {
+			log.Fatalf("wrong error for %s: %v", expr, err)
+		}
+	}
+
+	if _, err := p.XPath("count('a')"); err == nil {
+		log.Fatal("expected error for non node-set argument")
+	}
+}
+
+func Test_TextPseudoClasses(t *testing.T) {
+	data := []byte(`<table><tr><th>Name</th><td id="a">Foo</td></tr><tr><th> Unit
+	price </th><td id="b">12.50</td></tr><tr><th>Price &amp; tax</th><td id="c">15</td></tr></table>`)
+	c := NewParser(&data, false, nil)
+
+	cases := map[string]string{
+		`th:contains("Name") + td`:           "a",
+		`th:contains(price) + td`:            "b",
+		`th:contains('Price') ~ td`:          "c",
+		`th:contains("Price & tax") + td`:    "c",
+		`td:matches(/^\d+\.\d+$/)`:           "b",
+		`td:matches("^1")`:                   "bc",
+		`th:matches(/^name$/i) + td`:         "a",
+		`th:has-text("unit price") + td`:     "b",
+		`th:has-text(PRICE) + td`:            "bc",
+		`th:has-text(/tax$/) + td`:           "c",
+		`tr:has(th:contains("Name")) td`:     "a",
+		`td:not(:contains("1"))`:             "a",
+		`th:contains("Name") + td, #c`:       "ac",
+		`tr:has-text("foo") > td:last-child`: "a",
+	}
+
+	for query, ids := range cases {
+		tags := c.Query(query).Get()
+		builder := strings.Builder{}
+
+		if tags != nil {
+			for _, tag := range *tags {
+				builder.WriteString(tag.Attributes["id"])
+			}
+		}
+
+		if builder.String() != ids {
+			log.Fatalf("wrong result for %s: %s", query, builder.String())
+		}
+	}
+
+	for _, selector := range []string{`td:matches(/(/)`, `td:contains("a)`, `td:matches(/a/x)`, `td:contains`} {
+		if _, err := Compile(selector); err == nil {
+			log.Fatalf("expected error for %s", selector)
+		}
+	}
+}
+
+func Test_Namespaces(t *testing.T) {
+	payload := []byte(`<?xml version="1.0"?><rss xmlns:media="http://search.yahoo.com/mrss/" xmlns:m="http://search.yahoo.com/mrss/"><channel><item><media:content url="a"><media:title>T</media:title></media:content><title>x</title><m:content url="b"/></item><svg xmlns="http://www.w3.org/2000/svg"><rect id="r"/></svg><content url="c"/></channel></rss>`)
+	p := NewParser(&payload, false, nil)
+
+	urls := func(query string) string {
+		builder := strings.Builder{}
+
+		if tags := p.Query(query).Get(); tags != nil {
+			for _, tag := range *tags {
+				builder.WriteString(tag.Attributes["url"] + tag.Attributes["id"])
+			}
+		}
+
+		return builder.String()
+	}
+
+	if tag := p.Query("media|title").First(); tag.InnerText() != "T" || tag.Parent().Name != "content" {
+		log.Fatal("namespaced element not closed")
+	}
+
+	if p.Query("item > title").First().InnerText() != "x" {
+		log.Fatal("wrong title")
+	}
+
+	p.RegisterNamespace("svg", "http://www.w3.org/2000/svg")
+
+	cases := map[string]string{
+		"media|content":       "ab",
+		"m|content":           "ab",
+		`media\:content`:      "ab",
+		"*|content":           "abc",
+		"|content":            "c",
+		"content":             "abc",
+		"item > media|*[url]": "ab",
+		"svg|rect":            "r",
+		"|rect":               "",
+		"other|content":       "",
+	}
+
+	for query, expected := range cases {
+		if result := urls(query); result != expected {
+			log.Fatalf("wrong result for %s: %s", query, result)
+		}
+	}
+
+	if result, _ := p.XPath("//m:content/@url"); strings.Join(result.Strings(), "") != "ab" {
+		log.Fatal("wrong xpath result")
+	}
+
+	if result, _ := p.XPath("namespace-uri(//svg:rect)"); result.String() != "http://www.w3.org/2000/svg" {
+		log.Fatal("wrong namespace uri")
+	}
+
+	if _, err := Compile("media|"); err == nil {
+		log.Fatal("expected error for missing name")
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	errorsOf := func(body string) string {
+		b := []byte(body)
+		result := make([]string, 0)
+
+		for _, err := range NewParser(&b, false, nil).Errors() {
+			result = append(result, err.Error())
+		}
+
+		return strings.Join(result, "; ")
+	}
+
+	cases := map[string]string{
+		"<div>\n  <span>a</div>": "unclosed tag <span> at line 2, column 3",
+		"<div>a</p></div>":       "unexpected end tag </p> at line 1, column 7",
+		"<a x=1 x=2>b</a>":       "bad attribute 'x' at line 1, column 8",
+		"<div><!-- a</div>":      "unclosed tag <div> at line 1, column 1; unterminated comment at line 1, column 6",
+		"<script>var a":          "unterminated <script> at line 1, column 1",
+		"<div>ü\n ü<b>x</div>":   "unclosed tag <b> at line 2, column 3",
+		"<ul><li>a<li>b</ul>":    "",
+		"<html><body><p>x":       "",
+		"<svg:g><svg:a></svg:g>": "unclosed tag <svg:a> at line 1, column 8",
+		"<a href=x ":             "unterminated tag <a> at line 1, column 1",
+		"<div><br":               "unclosed tag <div> at line 1, column 1; unterminated tag <br> at line 1, column 6",
+		"<p>a<b c":               "unterminated tag <b> at line 1, column 5",
+	}
+
+	for body, expected := range cases {
+		if result := errorsOf(body); result != expected {
+			log.Fatalf("wrong errors for %q: %s", body, result)
+		}
+	}
+
+	b := []byte("<a href=\"x>b</a>")
+	errors := NewParser(&b, false, nil).Errors()
+
+	if len(errors) == 0 || errors[0].Kind != BadAttribute || errors[0].Name != "href" || errors[0].Offset != 3 {
+		log.Fatal("expected bad attribute error")
+	}
+
+	// errors are copies and queries on the parsed tree report nothing
+	b = []byte("<p>c</p><div>a<!-- b</div>")
+	p := NewParser(&b, false, nil)
+	errors = p.Errors()
+	errors[0].Line = 99
+	_, _ = p.XPath("//comment() | //text()")
+	_ = p.Query("p").First().InnerText()
+
+	if after := p.Errors(); len(after) != len(errors) || after[0].Line != 1 || p.errors[0].Line != 0 {
+		log.Fatal("errors changed after parsing")
+	}
+
+	// tags cut off by the end of the input
+	document := `<div class=a id = 'b' data-x=y disabled><img src="a.png" /><br><svg:g x:y="1"></svg:g></div>`
+
+	for i := range document {
+		b = []byte(document[:i])
+		NewParser(&b, false, nil).Errors()
+	}
+}
+
+func Test_TagPosition(t *testing.T) {
+	b := []byte("<html>\n<body>\n  <p>ä <b>x</b></p>\n\t<div\n id=a></div>\n</body>\n</html>")
+	p := NewParser(&b, false, nil)
+
+	cases := map[string]string{
+		"p":    "3:3",
+		"b":    "3:8",
+		"#a":   "4:2",
+		"html": "1:1",
+	}
+
+	for query, expected := range cases {
+		if position := p.Query(query).First().Position().String(); position != expected {
+			log.Fatalf("wrong position for %s: %s", query, position)
+		}
+	}
+
+	if end := p.Query("b").First().EndPosition(); end.Line != 3 || end.Column != 16 || end.Offset != 30 {
+		log.Fatalf("wrong end position %v", end)
+	}
+
+	if position := p.Position(len(b) + 10); position.Line != 7 || position.Offset != len(b) {
+		log.Fatal("offset past the body not clamped")
+	}
+}
+
+func Test_EncodingDetection(t *testing.T) {
+	cases := []struct {
+		data        string
+		contentType string
+		expected    string
+	}{
+		{"\xEF\xBB\xBF<p>a</p>", "text/html; charset=shift_jis", "utf-8"},
+		{"\xFF\xFE<\x00p\x00>\x00", "", "utf-16le"},
+		{"<p>\xE9</p>", "text/html; charset=latin1", "windows-1252"},
+		{`<meta charset="Shift_JIS"><p>a</p>`, "text/html", "shift_jis"},
+		{`<meta http-equiv="Content-Type" content="text/html; charset='euc-jp'">`, "", "euc-jp"},
+		{`<!-- <meta charset="koi8-r"> --><meta charset=utf-16>`, "", "utf-8"},
+		{"<meta charset=\"bogus\"><p>\xE9</p>", "", "windows-1252"},
+		{"<p>\xC3\xA9</p>", "text/html; charset=bogus", "utf-8"},
+	}
+
+	for _, c := range cases {
+		if name := DetectEncoding([]byte(c.data), c.contentType); name != c.expected {
+			log.Fatalf("wrong encoding for %q: %s", c.data, name)
+		}
+	}
+
+	// tags crossing the end of the prescanned head
+	for _, tag := range []string{"<br", "<a", "<a href=x ", `<img src="a.png" `} {
+		head := `<meta charset="koi8-r">`
+		data := head + strings.Repeat(" ", prescanLength-len(head)-len(tag)+1) + tag + "></p>"
+
+		if name := DetectEncoding([]byte(data), ""); name != "koi8-r" {
+			log.Fatalf("wrong encoding with %q crossing the prescan: %s", tag, name)
+		}
+
+		if _, name, err := DecodeToUTF8([]byte(data[len(head):]), ""); err != nil || name != "utf-8" {
+			log.Fatalf("wrong encoding with %q crossing the prescan: %s", tag, name)
+		}
+	}
+
+	data, name, err := DecodeToUTF8([]byte("\xFE\xFF\x00<\x00p\x00>\x00\xE9"), "")
+
+	if err != nil || name != "utf-16be" || string(data) != "<p>é" {
+		log.Fatalf("wrong utf-16 decoding %q", data)
+	}
+}
+
+func Test_FetchEncoding(t *testing.T) {
+	// "日本" in shift_jis
+	body := "<html><head><meta charset=\"shift_jis\"></head><body><p>\x93\xFA\x96\x7B</p></body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latin" {
+			w.Header().Set("Content-Type", "text/html; charset=windows-1252")
+			_, _ = w.Write([]byte("<p>caf\xE9 \x80</p>"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(body))
+	}))
+
+	defer server.Close()
+
+	client := NewClient()
+	// splits multibyte characters across chunks
+	client.SetChunkSize(5)
+
+	for _, path := range []string{"/", "/latin"} {
+		address := server.URL + path
+		expected := map[string]string{"/": "日本", "/latin": "café €"}[path]
+
+		p, err := client.FetchParseSync(&Request{Url: &address})
+
+		if err != nil || p.Query("p").First().InnerText() != expected {
+			log.Fatalf("wrong sync text for %s", path)
+		}
+
+		p, err = client.FetchParseAsync(&Request{Url: &address})
+
+		if err != nil || p.Query("p").First().InnerText() != expected {
+			log.Fatalf("wrong async text for %s", path)
+		}
+
+		if p.Request.Encoding != map[string]string{"/": "shift_jis", "/latin": "windows-1252"}[path] {
+			log.Fatalf("wrong encoding %s", p.Request.Encoding)
+		}
+	}
+}
+
+func Test_StreamParser(t *testing.T) {
+	document := "<html><head><title>t</title></head><body>" + strings.Repeat(`<p class="x">abc</p>`, 500) + "</body></html>"
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(document))
+	_ = writer.Close()
+
+	reader, writerEnd := io.Pipe()
+
+	go func() {
+		for i := 0; i < len(document); i += 100 {
+			_, _ = writerEnd.Write([]byte(document[i:min(i+100, len(document))]))
+		}
+
+		_ = writerEnd.Close()
+	}()
+
+	gz, _ := gzip.NewReader(&compressed)
+
+	for _, r := range []io.Reader{strings.NewReader(document), reader, gz} {
+		calls := 0
+		hook := func(p *Parser) { calls++ }
+		p, err := NewStreamParser(r, Options{Hook: &hook, ChunkSize: 64})
+
+		if err != nil || len(*p.Query("p.x").Get()) != 500 || p.Query("title").First().InnerText() != "t" {
+			log.Fatal("wrong stream parse result")
+		}
+
+		if calls == 0 {
+			log.Fatal("hook not called")
+		}
+	}
+
+	stop := func(p *Parser) {
+		if p.Query("title").First().Exists() {
+			p.InBound = func(int) bool { return false }
+		}
+	}
+
+	// stopping early must not block the producer
+	p, err := NewStreamParser(strings.NewReader(document), Options{Hook: &stop, ChunkSize: 64})
+
+	if err != nil || !p.Done {
+		log.Fatal("parser not finished")
+	}
+
+	// a producer may also set Complete before sending the last chunk
+	data := []byte{}
+	body := []byte(document)
+	p = NewParser(&data, true, nil)
+	*p.Complete = true
+	p.DataChan <- &body
+	<-p.ParseComplete
+
+	if len(*p.Query("p.x").Get()) != 500 {
+		log.Fatal("wrong result for a body completed with Complete")
+	}
+}
+
+func Test_Tokenizer(t *testing.T) {
+	document := `<!DOCTYPE html><html lang=en><head><title>a<b></title><script>if (a < b) {"</div>"}</script ></head>` +
+		`<body class='x y' hidden><!-- c --><p>1 < 2 <br/><svg:rect x="1"/></p></body></html>`
+
+	expected := []string{
+		"doctype DOCTYPE html", "start html lang=en", "start head", "start title", "text a<b>", "end title",
+		"start script", `text if (a < b) {"</div>"}`, "end script", "end head", "start body class=x y hidden=",
+		"comment  c", "start p", "text 1 < 2", "self br", "self svg:rect x=1", "end p", "end body", "end html",
+	}
+
+	types := map[TokenType]string{
+		StartTagToken: "start", EndTagToken: "end", SelfClosingTagToken: "self",
+		TextToken: "text", CommentToken: "comment", DoctypeToken: "doctype",
+	}
+
+	for _, r := range []io.Reader{strings.NewReader(document), iotest.OneByteReader(strings.NewReader(document))} {
+		tokenizer := NewTokenizer(r)
+		tokens := make([]string, 0)
+
+		for tokenizer.Next() {
+			token := tokenizer.Token()
+			description := types[token.Type] + " " + string(token.Name) + string(token.Data)
+
+			for _, attribute := range token.Attributes {
+				description += " " + string(attribute.Name) + "=" + string(attribute.Value)
+			}
+
+			if document[token.Offset.Start:token.Offset.End] != string(token.Raw) {
+				log.Fatalf("wrong offsets for %s", token.Raw)
+			}
+
+			tokens = append(tokens, strings.TrimSpace(description))
+		}
+
+		if strings.Join(tokens, "|") != strings.Join(expected, "|") {
+			log.Fatalf("wrong tokens %v", tokens)
+		}
+	}
+
+	// tags cut off by the end of the input are text
+	for _, truncated := range []string{"<a ", "<a href=x ", "<a href=x", "<a href = ", `<a href="x`, "<br"} {
+		tokenizer := NewTokenizer(strings.NewReader("x" + truncated))
+
+		if !tokenizer.Next() || tokenizer.Token().Type != TextToken || !tokenizer.Next() {
+			log.Fatalf("wrong tokens for %q", truncated)
+		}
+
+		if token := tokenizer.Token(); token.Type != TextToken || string(token.Raw) != truncated || tokenizer.Next() {
+			log.Fatalf("truncated tag %q not tokenized as text", truncated)
+		}
+	}
+
+	// the buffer must not grow with the document
+	tokenizer := NewTokenizer(strings.NewReader(strings.Repeat("<p class=a>text</p>", 100000)))
+	count := 0
+
+	for tokenizer.Next() {
+		count++
+	}
+
+	if count != 300000 || cap(tokenizer.buffer) > tokenizerChunkSize {
+		log.Fatalf("unexpected token count %d or buffer size %d", count, cap(tokenizer.buffer))
+	}
+}
+
+func Test_Mutation(t *testing.T) {
+	// a mutated tree has to match a fresh parse of its markup
+	outline := func(p *Parser) string {
+		builder := strings.Builder{}
+
+		for _, tag := range p.GetOffsetList() {
+			builder.WriteString(fmt.Sprintf("%s%v%v ", tag.Name, tag.Tag, tag.Body))
+		}
+
+		return builder.String()
+	}
+
+	check := func(p *Parser) {
+		body := bytes.Clone(p.GetBody())
+
+		if outline(p) != outline(NewParser(&body, false, nil)) {
+			log.Fatalf("inconsistent offsets after mutation: %s", p.GetBody())
+		}
+	}
+
+	for _, nodes := range []bool{false, true} {
+		b := []byte(`<html><body><div id="a" class="x">one<p>two</p>three</div><ul><li>1</li><li>2</li></ul><br hidden></body></html>`)
+		p := NewParserWithOptions(&b, Options{Nodes: nodes})
+		div := p.Query("#a").First().Tag
+		ul := p.Query("ul").First().Tag
+
+		span := p.CreateElement("span")
+		_ = span.SetText("a & <b>")
+		_ = span.SetAttr("class", "y")
+
+		if div.AppendChild(span) != nil || p.Query("#a > .y").First().InnerText() != "a & <b>" {
+			log.Fatal("append failed")
+		}
+
+		check(p)
+
+		if ul.InsertBefore(p.Query("li").Last().Tag, ul.Children[0]) != nil || p.Query("li").First().InnerText() != "2" {
+			log.Fatal("insert failed")
+		}
+
+		check(p)
+		p.Query("p").First().Remove()
+
+		if p.Query("p").First().Exists() || p.Query("#a").First().InnerText() != "onethreea & <b>" {
+			log.Fatal("remove failed")
+		}
+
+		check(p)
+		_ = div.SetAttr("id", "b")
+		div.RemoveAttr("class")
+
+		if p.Query("#a").First().Exists() || p.Query(".x").First().Exists() || !p.Query("div#b").First().Exists() {
+			log.Fatal("attribute indexes not updated")
+		}
+
+		check(p)
+
+		if ul.Wrap(p.CreateElement("section")) != nil || ul.ReplaceWith(p.CreateElement("hr")) != nil {
+			log.Fatal("wrap or replace failed")
+		}
+
+		check(p)
+
+		expected := `<html><body><div id="b">onethree<span class="y">a &amp; &lt;b&gt;</span></div><section><hr></section><br hidden></body></html>`
+
+		if string(p.GetBody()) != expected {
+			log.Fatalf("wrong markup %s", p.GetBody())
+		}
+
+		if p.Query("br").First().SetText("x") != ErrNoContent || div.AppendChild(p.GetRoot()) != ErrHierarchy {
+			log.Fatal("expected mutation errors")
+		}
+
+		if div.Wrap(p.CreateElement("br")) != ErrNoContent || string(p.GetBody()) != expected {
+			log.Fatalf("failed wrap changed the markup %s", p.GetBody())
+		}
+
+		if nodes && p.NodeValue(span.node().Prev()) != "three" {
+			log.Fatal("nodes not updated")
+		}
+	}
+
+	// children replaced by text keep their markup
+	b := []byte(`<div><b>x</b></div><p>y</p>`)
+	p := NewParser(&b, false, nil)
+	bold := p.Query("b").First().Tag
+	_ = p.Query("div").First().SetText("z")
+
+	if p.Query("p").First().AppendChild(bold) != nil || string(p.GetBody()) != `<div>z</div><p>y<b>x</b></p>` {
+		log.Fatalf("replaced child not reinserted %s", p.GetBody())
+	}
+
+	check(p)
+
+	// entities stay as they are with RawEntities
+	b = []byte(`<div>x</div><title>t</title>`)
+	p = NewParserWithOptions(&b, Options{RawEntities: true})
+	_ = p.Query("div").First().SetText("a &amp; <b>")
+	_ = p.Query("title").First().SetText("&lt;")
+
+	if string(p.GetBody()) != `<div>a &amp; &lt;b></div><title>&lt;</title>` || p.Query("div").First().InnerText() != "a &amp; &lt;b>" {
+		log.Fatalf("wrong raw entity text %s", p.GetBody())
+	}
+
+	check(p)
+
+	// no mutation may panic on a tree the parser produced
+	for _, document := range []string{
+		`<text</table><li><plaintext><br></ul>`,
+		`<li></div></textarea><p><br><textarea>'?> <text<textarea>`,
+	} {
+		b := []byte(document)
+
+		for i := range *NewParser(&b, false, nil).GetTags("*") {
+			for _, mutate := range []func(p *Parser, tag *Tag){
+				func(p *Parser, tag *Tag) { _ = tag.SetText("z") },
+				func(p *Parser, tag *Tag) { _ = tag.AppendChild(p.CreateElement("i")) },
+				func(p *Parser, tag *Tag) { tag.Remove() },
+			} {
+				b := []byte(document)
+				p := NewParser(&b, false, nil)
+				mutate(p, (*p.GetTags("*"))[i])
+
+				if p.GetTags("*") == nil {
+					continue
+				}
+
+				for _, tag := range *p.GetTags("*") {
+					if tag.top() != p.GetRoot() {
+						log.Fatalf("tag <%s> outside of the tree in %s", tag.Name, p.GetBody())
+					}
+				}
+			}
+		}
+	}
+
+	// unterminated raw text elements still have a start tag to rewrite
+	for _, document := range []string{`<p>a</p><style>x`, `<b><title>x`, `<div><title>text</div>`, `</script><img src=a><script><x:y><div>'<li>`} {
+		b := []byte(document)
+
+		for i := range *NewParser(&b, false, nil).GetTags("*") {
+			b := []byte(document)
+			p := NewParser(&b, false, nil)
+			tag := (*p.GetTags("*"))[i]
+
+			if tag.SetAttr("a", "b") != nil || !strings.Contains(p.value(tag.Tag.Start, tag.Tag.End), ` a="b">`) {
+				log.Fatalf("attribute not set on <%s> in %s", tag.Name, p.GetBody())
+			}
+
+			check(p)
+		}
+	}
+}
+
+func Test_Render(t *testing.T) {
+	// unterminated raw text elements are rendered without their content
+	for document, expected := range map[string]string{
+		`<p>a</p><style>x`:       `<p>a</p><style></style>x`,
+		`<div><title>text</div>`: `<div><title></title>text</div>`,
+		`<b><title>x`:            `<b></b><title></title>x`,
+		// stray end tags are dropped
+		`</script><img src=a><script><x:y><div>'<li>`: `<img src="a"><script></script><x:y></x:y><div></div>'<li></li>`,
+	} {
+		b := []byte(document)
+		p := NewParser(&b, false, nil)
+
+		for _, mode := range []RenderMode{NormalizeMarkup, PrettyMarkup, MinifyMarkup} {
+			builder := strings.Builder{}
+
+			if err := p.RenderWithOptions(&builder, RenderOptions{Mode: mode}); err != nil {
+				log.Fatal(err)
+			}
+
+			if mode == NormalizeMarkup && builder.String() != expected {
+				log.Fatalf("wrong markup %s", builder.String())
+			}
+		}
+	}
+
+	b := []byte("<!DOCTYPE html>\n<HTML><head><title>a &amp; b</title><script>if (a<b) x='&amp;'</script></head>" +
+		"<body CLASS=x hidden><!-- c -->\n<p>1 &lt; 2<br><img src=a.png alt='q\"x'><li>a<li>b</ul><svg:rect x=1 /></body></HTML>")
+
+	expected := "<!DOCTYPE html>\n<html><head><title>a &amp; b</title><script>if (a<b) x='&amp;'</script></head>" +
+		`<body class="x" hidden><!-- c -->` + "\n" + `<p>1 &lt; 2<br><img src="a.png" alt="q&quot;x"></p><li>a</li><li>b<svg:rect x="1"/></li></body></html>`
+
+	for _, nodes := range []bool{false, true} {
+		p := NewParserWithOptions(&b, Options{Nodes: nodes})
+		builder := strings.Builder{}
+
+		if p.Render(&builder); builder.String() != string(b) {
+			log.Fatal("preserved markup differs")
+		}
+
+		builder.Reset()
+
+		if p.RenderWithOptions(&builder, RenderOptions{Mode: NormalizeMarkup}); builder.String() != expected {
+			log.Fatalf("wrong normalized markup %s", builder.String())
+		}
+
+		builder.Reset()
+		_ = p.Query("img").First().SetAttr("alt", "<&>")
+		_ = p.Query("p").First().RenderWithOptions(&builder, RenderOptions{Mode: NormalizeMarkup})
+
+		if !strings.HasPrefix(builder.String(), `<p>1 &lt; 2<br><img src="a.png" alt="<&amp;>"></p>`) {
+			log.Fatalf("wrong tag markup %s", builder.String())
+		}
+
+		builder.Reset()
+		_ = p.Query("svg|rect, rect").First().Render(&builder)
+
+		if builder.String() != "<svg:rect x=1 />" {
+			log.Fatalf("untouched tag not preserved %s", builder.String())
+		}
+	}
+}
+
+func Test_RenderModes(t *testing.T) {
+	b := []byte("<!DOCTYPE html>\n<html><head> <title> a &amp;  b </title>\n<script>if (a<b)\n  x()</script></head>" +
+		"<body class=\"x y\" hidden id=main><!-- c -->\n<div>Hello <b>big</b>\n world<p>one\n two</p><pre>  keep\n </pre>" +
+		"<ul><li>a<li><a href='/x/'>b</a></ul></div></body></html>")
+
+	pretty := "<!DOCTYPE html>\n<html>\n  <head>\n    <title>a &amp; b</title>\n    <script>if (a<b)\n  x()</script>\n  </head>\n" +
+		"  <body class=\"x y\" hidden id=\"main\">\n    <!-- c -->\n    <div>\n      Hello <b>big</b> world\n      <p>one two</p>\n" +
+		"      <pre>  keep\n </pre>\n      <ul>\n        <li>a</li>\n        <li><a href=\"/x/\">b</a></li>\n      </ul>\n    </div>\n  </body>\n</html>\n"
+
+	minified := "<!DOCTYPE html><html><head><title>a &amp; b</title><script>if (a<b)\n  x()</script></head>" +
+		"<body class=\"x y\" hidden id=main><div>Hello <b>big</b> world<p>one two</p><pre>  keep\n </pre>" +
+		"<ul><li>a</li><li><a href=\"/x/\">b</a></li></ul></div></body></html>"
+
+	for _, nodes := range []bool{false, true} {
+		for _, c := range []struct {
+			mode     RenderMode
+			expected string
+		}{{PrettyMarkup, pretty}, {MinifyMarkup, minified}} {
+			p := NewParserWithOptions(&b, Options{Nodes: nodes})
+			builder := strings.Builder{}
+
+			_ = p.RenderWithOptions(&builder, RenderOptions{Mode: c.mode})
+
+			if builder.String() != c.expected {
+				log.Fatalf("wrong markup %s", builder.String())
+			}
+
+			// rendering the output again changes nothing
+			output := []byte(builder.String())
+			builder.Reset()
+
+			_ = NewParser(&output, false, nil).RenderWithOptions(&builder, RenderOptions{Mode: c.mode})
+
+			if builder.String() != c.expected {
+				log.Fatalf("rendering is not stable %s", builder.String())
+			}
+		}
+	}
+
+	p := NewParser(&b, false, nil)
+	builder := strings.Builder{}
+	_ = p.Query("ul").First().RenderWithOptions(&builder, RenderOptions{Mode: PrettyMarkup, Indent: "\t"})
+
+	if builder.String() != "<ul>\n\t<li>a</li>\n\t<li><a href=\"/x/\">b</a></li>\n</ul>\n" {
+		log.Fatalf("wrong tag markup %s", builder.String())
+	}
+}
+
+func Test_CDataAndProcessingInstructions(t *testing.T) {
+	data := []byte(`<?xml version="1.0"?><?xml-stylesheet href="feed.xsl"?><rss><channel><item>` +
+		`<title>a &amp; <![CDATA[b & <i>c</i>]]></title><description><![CDATA[<p>Hello</p> & ]]>bye</description>` +
+		`<?php echo "<b>"; ?></item></channel></rss>`)
+
+	for _, nodes := range []bool{false, true} {
+		p := NewParserWithOptions(&data, Options{Nodes: nodes})
+
+		if p.Query("p, i, b").First().Exists() || len(*p.GetTags("*")) != 5 {
+			log.Fatal("markup in cdata sections or processing instructions parsed as tags")
+		}
+
+		if text := p.Query("title").First().InnerText(); text != "a & b & <i>c</i>" {
+			log.Fatalf("wrong cdata text %q", text)
+		}
+
+		if text := p.Query("description").First().InnerText(); text != "<p>Hello</p> & bye" {
+			log.Fatalf("wrong cdata text %q", text)
+		}
+
+		result, err := p.XPath("//processing-instruction()")
+
+		if err != nil || strings.Join(result.Strings(), "|") != `href="feed.xsl"|echo "<b>"; ` {
+			log.Fatalf("wrong processing instructions %v %v", result.Strings(), err)
+		}
+
+		result, _ = p.XPath("name(//item/processing-instruction('php'))")
+
+		if result.String() != "php" {
+			log.Fatalf("wrong processing instruction target %s", result.String())
+		}
+
+		if result, _ = p.XPath("string(//description/text()[1])"); result.String() != "<p>Hello</p> & " {
+			log.Fatalf("wrong cdata text node %s", result.String())
+		}
+
+		builder := strings.Builder{}
+		_ = p.RenderWithOptions(&builder, RenderOptions{Mode: NormalizeMarkup})
+
+		if builder.String() != string(data) {
+			log.Fatalf("sections not rendered %s", builder.String())
+		}
+	}
+
+	p := NewParserWithOptions(&data, Options{Nodes: true})
+	description := p.Query("description").First().Tag
+
+	if description.Nodes[0].Type != CDataNode || p.NodeValue(description.Nodes[0]) != "<p>Hello</p> & " {
+		log.Fatal("missing cdata node")
+	}
+
+	if node := p.root.Nodes[0]; node.Type != ProcessingInstructionNode || p.NodeValue(node) != `xml-stylesheet href="feed.xsl"` {
+		log.Fatal("missing processing instruction node")
+	}
+
+	data = []byte(`<?php echo 1; ?><div><![CDATA[<div>`)
+	p = NewParser(&data, false, nil)
+	errs := p.Errors()
+
+	if len(*p.GetTags("div")) != 1 || len(errs) != 2 || errs[1].Error() != "unterminated cdata section at line 1, column 22" {
+		log.Fatalf("unexpected errors %v", errs)
+	}
+
+	// html only knows cdata sections in foreign content
+	data = []byte(`<div>a<![CDATA[<x>]]>b</div><svg><text>a<![CDATA[<x>]]>b</text></svg>`)
+	p = NewParser(&data, false, nil)
+
+	if p.Query("div").First().InnerText() != "a<![CDATA[<x>]]>b" || p.Query("text").First().InnerText() != "a<x>b" {
+		log.Fatal("cdata section unwrapped outside of foreign content")
+	}
+
+	// and ends processing instructions with the first '>'
+	data = []byte(`<div><?php $a > 1; ?>x</div>`)
+	p = NewParserWithOptions(&data, Options{Nodes: true})
+
+	if nodes := p.Query("div").First().Nodes; len(nodes) != 2 || p.NodeValue(nodes[0]) != "php $a " || p.NodeValue(nodes[1]) != " 1; ?>x" {
+		log.Fatal("wrong html processing instruction")
+	}
+
+	document := "<svg><![CDATA[" + strings.Repeat("x", 1000)
+	p, _ = NewStreamParser(strings.NewReader(document), Options{Nodes: true, ChunkSize: 16})
+
+	if node := p.GetRoot().Nodes[1]; node.Type != CDataNode || node.Offset.End != len(document) {
+		log.Fatal("wrong end of an unterminated cdata section in a stream")
+	}
+
+	tokenizer := NewTokenizer(strings.NewReader("<p><?php $a > 1; ?>" + strings.Repeat("x", 10*tokenizerChunkSize)))
+
+	for tokenizer.Next() {
+		if token := tokenizer.Token(); token.Type == ProcessingInstructionToken && string(token.Data) != "php $a " {
+			log.Fatalf("wrong html processing instruction token %s", token.Data)
+		}
+	}
+
+	tokenizer = NewTokenizer(strings.NewReader(`<?xml-stylesheet href="a"?><a><![CDATA[<b>]]></a>`))
+	tokens := make([]string, 0)
+
+	for tokenizer.Next() {
+		tokens = append(tokens, fmt.Sprintf("%d %s", tokenizer.Token().Type, tokenizer.Token().Data))
+	}
+
+	if strings.Join(tokens, "|") != fmt.Sprintf(`%d xml-stylesheet href="a"|%d |%d <b>|%d `, ProcessingInstructionToken, StartTagToken, CDataToken, EndTagToken) {
+		log.Fatalf("wrong tokens %v", tokens)
+	}
+}
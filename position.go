@@ -0,0 +1,40 @@
+package parseur
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// 1-based line and column, columns count characters rather than bytes
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// maps a byte offset into the body to a line and column, line starts are
+// indexed on first use and extended as the body grows
+func (p *Parser) Position(offset int) Position {
+	body := *p.body
+
+	if p.lines == nil {
+		p.lines = []int{0}
+	}
+
+	for ; p.indexed < len(body); p.indexed++ {
+		if body[p.indexed] == '\n' {
+			p.lines = append(p.lines, p.indexed+1)
+		}
+	}
+
+	offset = max(0, min(offset, len(body)))
+	line := sort.SearchInts(p.lines, offset+1) - 1
+	column := utf8.RuneCount(body[p.lines[line]:offset]) + 1
+
+	return Position{Offset: offset, Line: line + 1, Column: column}
+}
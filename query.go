@@ -1,15 +1,19 @@
 package parseur
 
 import (
-	"log"
+	"fmt"
 	"sort"
 	"strings"
 )
 
 type Query struct {
-	query  string
-	tags   *[]*Tag
-	parser *Parser
+	query    string
+	selector *Selector
+	tags     *[]*Tag
+	scope    *[]*Tag
+	parser   *Parser
+	reverse  bool
+	err      error
 }
 
 func (p *Parser) Query(query string) *Query {
@@ -17,12 +21,34 @@ func (p *Parser) Query(query string) *Query {
 	return &q
 }
 
+func (p *Parser) Select(selector *Selector) *Query {
+	q := Query{query: selector.source, selector: selector, parser: p}
+	return &q
+}
+
 func (q *Query) Query(query string) *Query {
-	if q.tags == nil {
-		q.tags = q.parseQuery()
+	q.scope = q.execute().tags
+
+	if q.scope == nil {
+		q.scope = &[]*Tag{}
 	}
 
-	q.query = " " + query
+	q.query = query
+	q.selector = nil
+
+	return q
+}
+
+func (q *Query) Select(selector *Selector) *Query {
+	q.Query(selector.source)
+	q.selector = selector
+
+	return q
+}
+
+// results are in document order unless reversed
+func (q *Query) Reverse() *Query {
+	q.reverse = !q.reverse
 
 	return q
 }
@@ -68,7 +94,7 @@ func (qt *QueryTag) InnerText() string {
 				length := child.Tag.Start - offset
 
 				if length > 0 {
-					builder.WriteString(qt.parser.value(offset, offset+length))
+					builder.WriteString(qt.parser.text(tag, offset, offset+length))
 				}
 
 				reduce(child)
@@ -77,7 +103,7 @@ func (qt *QueryTag) InnerText() string {
 			}
 
 			if offset < tag.Body.End {
-				builder.WriteString(qt.parser.value(offset, tag.Body.End))
+				builder.WriteString(qt.parser.text(tag, offset, tag.Body.End))
 			}
 		}
 
@@ -86,6 +112,10 @@ func (qt *QueryTag) InnerText() string {
 		return builder.String()
 }
 
+func (p *Parser) innerText(tag *Tag) string {
+	return (&QueryTag{tag, p}).InnerText()
+}
+
 func (qt *QueryTag) OuterText() string {
 	return qt.parser.value(qt.Tag.Tag.Start, qt.Tag.Tag.End)
 }
@@ -104,21 +134,100 @@ func (q *Query) toQueryTags() *[]*QueryTag {
 	return &tags
 }
 
+func (qt *QueryTag) wrap(tag *Tag) *QueryTag {
+	if tag == nil {
+		return &QueryTag{}
+	}
+
+	return &QueryTag{tag, qt.parser}
+}
+
+func (qt *QueryTag) Parent() *QueryTag {
+	if qt.Tag == nil {
+		return &QueryTag{}
+	}
+
+	return qt.wrap(qt.Tag.Parent())
+}
+
+func (qt *QueryTag) NextSibling() *QueryTag {
+	if qt.Tag == nil {
+		return &QueryTag{}
+	}
+
+	return qt.wrap(qt.Tag.NextSibling())
+}
+
+func (qt *QueryTag) PrevSibling() *QueryTag {
+	if qt.Tag == nil {
+		return &QueryTag{}
+	}
+
+	return qt.wrap(qt.Tag.PrevSibling())
+}
+
+func (qt *QueryTag) Ancestors() *[]*QueryTag {
+	tags := make([]*QueryTag, 0)
+
+	if qt.Tag == nil {
+		return &tags
+	}
+
+	for _, tag := range qt.Tag.Ancestors() {
+		tags = append(tags, qt.wrap(tag))
+	}
+
+	return &tags
+}
+
+// an invalid selector matches no ancestor, Compile reports why
+func (qt *QueryTag) Closest(query string) *QueryTag {
+	if qt.Tag == nil {
+		return &QueryTag{}
+	}
+
+	selector, err := Compile(query)
+
+	if err != nil {
+		return &QueryTag{}
+	}
+
+	for tag := qt.Tag; tag.parent != nil; tag = tag.parent {
+		if candidate := qt.wrap(tag); selector.Match(candidate) {
+			return candidate
+		}
+	}
+
+	return &QueryTag{}
+}
+
 func (qt *QueryTag) Exists() bool {
 	return qt.Tag != nil && qt.Body.End != PARSING
 }
 
 func (qt *QueryTag) Query(query string) *Query {
-	tags := []*Tag{qt.Tag}
+	tags := []*Tag{}
+
+	if qt.Tag != nil {
+		tags = append(tags, qt.Tag)
+	}
+
 	q := &Query{
 		parser: qt.parser,
-		query:  " " + query,
-		tags:   &tags,
+		query:  query,
+		scope:  &tags,
 	}
 
 	return q
 }
 
+func (qt *QueryTag) Select(selector *Selector) *Query {
+	q := qt.Query(selector.source)
+	q.selector = selector
+
+	return q
+}
+
 func (q *Query) Get() *[]*QueryTag {
 	q.execute()
 
@@ -132,102 +241,99 @@ func (q *Query) execute() *Query {
 
 	q.tags = q.parseQuery()
 
-	return q
-}
-
-func (q *Query) parseQuery() *[]*Tag {
-	var tags = q.tags
-	var qualifiers *[]string
-
-	length := len(q.query)
-
-	for i := 0; i < length; i++ {
-
-		switch q.query[i] {
-		case ' ':
-			for ; i < length && q.query[i] == ' '; i++ {
-			}
-
-			qualifiers, i = q.parseQualifiers(i)
-
-			if len(*qualifiers) == 0 {
-				continue
-			}
-
-			var filteredTags []*Tag
+	if q.reverse && q.tags != nil {
+		length := len(*q.tags)
+		tags := make([]*Tag, length)
 
-			for _, tag := range *tags {
-				filterDeep(&tag.Children, qualifiers, &filteredTags)
-			}
-
-			tags = &filteredTags
+		for i, tag := range *q.tags {
+			tags[length-1-i] = tag
+		}
 
-			if tags == nil {
-				return nil
-			}
+		q.tags = &tags
+	}
 
-			continue
+	return q
+}
 
-		case '>':
+// the *SelectorError of an invalid selector in the chain, which matches
+// nothing
+func (q *Query) Err() error {
+	return q.err
+}
 
-			if tags == nil {
-				return nil
-			}
+func (q *Query) parseQuery() *[]*Tag {
+	if q.selector == nil {
+		if strings.TrimSpace(q.query) == "" {
+			return q.scope
+		}
 
-			for i += 1; i < length && q.query[i] == ' '; i++ {
-			}
+		selector, err := Compile(q.query)
 
-			qualifiers, i = q.parseQualifiers(i)
+		if err != nil {
+			q.err = err
+			return nil
+		}
 
-			if qualifiers == nil {
-				continue
-			}
+		q.selector = selector
+	}
 
-			var filteredTags []*Tag
+	matched := make(map[*Tag]struct{})
+	tags := make([]*Tag, 0)
 
-			for _, t := range *tags {
-				filteredTags = append(filteredTags, t.Children...)
+	for _, steps := range q.selector.selectors {
+		for _, tag := range q.selectSteps(steps) {
+			if _, ok := matched[tag]; !ok {
+				matched[tag] = struct{}{}
+				tags = append(tags, tag)
 			}
+		}
+	}
 
-			*tags = (*tags)[:0]
-
-			for _, s := range filteredTags {
-				if matchQualifiersDeep(qualifiers, s) {
-					*tags = append(*tags, s)
-				}
-			}
+	if len(tags) == 0 {
+		return nil
+	}
 
-			if len(*tags) == 0 {
-				return nil
-			}
+	if len(q.selector.selectors) > 1 {
+		sort.SliceStable(tags, func(a, b int) bool {
+			return tags[a].Tag.Start < tags[b].Tag.Start
+		})
+	}
 
-		case '*':
-			tags = q.parser.GetTags("*")
-		default:
-			qualifiers, i = q.parseQualifiers(i)
+	return &tags
+}
 
-			if qualifiers == nil || len(*qualifiers) == 0 {
-				log.Panicf("invalid query '%s'", q.query)
-			}
+func (q *Query) selectSteps(steps []selectorStep) []*Tag {
+	candidates := q.extractQualifiers(steps[len(steps)-1].qualifiers)
 
-			tags = q.extractQualifiers(qualifiers)
+	if candidates == nil {
+		return nil
+	}
 
-			qualifiers = nil
+	tags := make([]*Tag, 0)
 
+	for _, tag := range *candidates {
+		if q.matchScoped(steps, tag) {
+			tags = append(tags, tag)
 		}
 	}
 
 	return tags
 }
 
-func filterDeep(tags *[]*Tag, qualifiers *[]string, container *[]*Tag) {
-	for _, t := range *tags {
-		if matchQualifiersDeep(qualifiers, t) {
-			*container = append(*container, t)
-		}
+func (q *Query) matchScoped(steps []selectorStep, tag *Tag) bool {
+	last := len(steps) - 1
 
-		filterDeep(&t.Children, qualifiers, container)
+	if q.scope == nil {
+		return q.parser.matchSteps(steps, last, tag, q.parser.root)
 	}
+
+	for _, scope := range *q.scope {
+		if q.parser.matchSteps(steps, last, tag, scope) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func getQualifier(query *string, i int) int {
@@ -247,120 +353,124 @@ func isValidQualifierChar(c uint8) bool {
 		c == '-' || c == '_'
 }
 
-func cmpQualifier(qualifiers *[]string) func(int, int) bool {
-	return func(a, b int) bool {
-		return (*qualifiers)[a][0] == '#'
+func qualifierRank(qualifier string) int {
+	switch qualifier[0] {
+	case '#':
+		return 0
+	case '.':
+		return 1
+	case '[', ':':
+		return 3
+	default:
+		return 2
 	}
 }
 
-func (q *Query) parseQualifiers(i int) (*[]string, int) {
-	var qualifiers []string
+type qualifier struct {
+	value      string
+	namespace  string
+	namespaced bool
+	attribute  *attributeSelector
+	pseudo     *pseudoSelector
+}
+
+func (q *qualifier) indexed() bool {
+	return qualifierRank(q.value) < 3
+}
+
+func (q *qualifier) match(p *Parser, t *Tag) bool {
+	switch {
+	case q.attribute != nil:
+		return q.attribute.match(p, t)
+	case q.pseudo != nil:
+		return q.pseudo.match(p, t)
+	case q.value[0] == '.':
+		return containsWord(t.Attributes["class"], q.value[1:])
+	case q.value[0] == '#':
+		return t.Attributes["id"] == q.value[1:]
+	case q.namespaced && !p.inNamespace(t, q.namespace):
+		return false
+	}
 
-	length := len(q.query)
+	return q.value == "*" || t.Name == p.normalizeName(q.value)
+}
+
+// parses the compound selector starting at i and returns its qualifiers,
+// indexed ones first, along with the index following it
+func parseQualifiers(selector string, i int, offset int) ([]*qualifier, int, *SelectorError) {
+	qualifiers := make([]*qualifier, 0)
+	length := len(selector)
 
 	for i < length {
 		start := i
+		current := &qualifier{}
 
-		if q.query[i] == '.' || q.query[i] == '#' {
-			i += 1
-		}
+		switch selector[i] {
+		case '[':
+			var ok bool
+			i = skipAttributeSelector(selector, i)
 
-		i = getQualifier(&q.query, i)
+			if current.attribute, ok = parseAttributeSelector(selector[start:i]); !ok {
+				return nil, i, &SelectorError{Offset: offset + start, Reason: "invalid attribute selector"}
+			}
+		case ':':
+			var err *SelectorError
+			i = skipPseudoSelector(selector, i)
+
+			if current.pseudo, err = parsePseudoSelector(selector[start:i], offset+start); err != nil {
+				return nil, i, err
+			}
+		case '.', '#':
+			if i = getQualifier(&selector, i+1); i == start+1 {
+				return nil, i, &SelectorError{Offset: offset + start, Reason: fmt.Sprintf("missing name after '%c'", selector[start])}
+			}
+		default:
+			var err *SelectorError
+
+			if i, err = parseTypeSelector(selector, i, offset, current); err != nil {
+				return nil, i, err
+			}
+		}
 
 		if i == start {
 			break
 		}
 
-		qualifier := q.query[start:i]
-
-		qualifiers = append(qualifiers, qualifier)
+		if current.value == "" {
+			current.value = selector[start:i]
+		}
 
+		qualifiers = append(qualifiers, current)
 	}
 
-	sort.Slice(qualifiers, cmpQualifier(&qualifiers))
-	return &qualifiers, i - 1
-}
+	sort.SliceStable(qualifiers, func(a, b int) bool {
+		return qualifierRank(qualifiers[a].value) < qualifierRank(qualifiers[b].value)
+	})
 
-func (q *Query) extractQualifiers(qualifiers *[]string) *[]*Tag {
-	var tags *[]*Tag
-	tags = q.parser.GetTags((*qualifiers)[0])
+	return qualifiers, i, nil
+}
 
-	if len(*qualifiers) == 1 {
-		return tags
+func (q *Query) extractQualifiers(qualifiers []*qualifier) *[]*Tag {
+	if len(qualifiers) == 0 || !qualifiers[0].indexed() {
+		return q.parser.GetTags("*")
 	}
 
-	var filteredTags []*Tag
-
-	*qualifiers = (*qualifiers)[1:]
-	filterDeep(tags, qualifiers, &filteredTags)
-	tags = &filteredTags
+	name := qualifiers[0].value
 
-	if len(*tags) == 0 {
-		return nil
+	// type selectors match case-insensitively in html like the tag names
+	if qualifierRank(name) == 2 {
+		name = q.parser.normalizeName(name)
 	}
 
-	return tags
+	return q.parser.GetTags(name)
 }
 
-func matchQualifiersDeep(qualifiers *[]string, t *Tag) bool {
-	length := len(*qualifiers)
-
-	for i := 0; i < length; i++ {
-		qualifier := (*qualifiers)[i]
-
-		if qualifier[0] == '.' {
-			if !hasSubstr(t.Attributes["class"], qualifier[1:]) {
-				return false
-			}
-		} else if qualifier[0] == '#' {
-			if t.Attributes["id"] != qualifier[1:] {
-				return false
-			}
-		} else if t.Name != qualifier {
+func (p *Parser) matchQualifiers(qualifiers []*qualifier, t *Tag) bool {
+	for _, qualifier := range qualifiers {
+		if !qualifier.match(p, t) {
 			return false
 		}
 	}
 
 	return true
 }
-
-func hasSubstr(hay string, needle string) bool {
-	lengthNeedle := len(needle)
-	length := len(hay)
-
-	if lengthNeedle > length {
-		return false
-	}
-
-	for i := 0; i < length; i++ {
-		if hay[i] == needle[0] {
-			if length-i < lengthNeedle {
-				break
-			}
-
-			p := 0
-
-			for z := i; p < lengthNeedle && needle[p] == hay[z]; {
-				p++
-				z++
-			}
-
-			stringMatched := p == length &&
-				i+p >= length || !isValidQualifierChar(hay[i+p])
-			if stringMatched {
-				return true
-			}
-		}
-
-		for i < length && hay[i] != ' ' {
-			i++
-		}
-
-		for z := i + 1; z < length && hay[z] == ' '; {
-			z++
-			i++
-		}
-	}
-
-	return false
-}
@@ -0,0 +1,195 @@
+package parseur
+
+import "strings"
+
+type attributeSelector struct {
+	name     string
+	operator string
+	value    string
+	foldCase bool
+	hasValue bool
+}
+
+func skipAttributeSelector(query string, i int) int {
+	length := len(query)
+
+	for i += 1; i < length && query[i] != ']'; i++ {
+		if query[i] != '"' && query[i] != '\'' {
+			continue
+		}
+
+		literal := query[i]
+
+		for i += 1; i < length && query[i] != literal; i++ {
+			if query[i] == '\\' {
+				i++
+			}
+		}
+	}
+
+	if i < length {
+		i++
+	}
+
+	return i
+}
+
+func parseAttributeSelector(qualifier string) (*attributeSelector, bool) {
+	length := len(qualifier)
+
+	if length < 3 || qualifier[0] != '[' || qualifier[length-1] != ']' {
+		return nil, false
+	}
+
+	selector := &attributeSelector{}
+	i := skipSpaces(qualifier, 1)
+	start := i
+
+	for i < length && !isAttributeSelectorDelimiter(qualifier[i]) {
+		i++
+	}
+
+	if i == start {
+		return nil, false
+	}
+
+	selector.name = qualifier[start:i]
+	i = skipSpaces(qualifier, i)
+
+	if qualifier[i] == ']' {
+		return selector, i == length-1
+	}
+
+	if qualifier[i] == '=' {
+		selector.operator = "="
+		i++
+	} else if i+1 < length && qualifier[i+1] == '=' && strings.IndexByte("~|^$*", qualifier[i]) != -1 {
+		selector.operator = qualifier[i : i+2]
+		i += 2
+	} else {
+		return nil, false
+	}
+
+	i = skipSpaces(qualifier, i)
+	start = i
+
+	if qualifier[i] == '"' || qualifier[i] == '\'' {
+		literal := qualifier[i]
+		builder := strings.Builder{}
+
+		for i += 1; i < length && qualifier[i] != literal; i++ {
+			if qualifier[i] == '\\' && i+1 < length {
+				i++
+			}
+
+			builder.WriteByte(qualifier[i])
+		}
+
+		if i >= length-1 {
+			return nil, false
+		}
+
+		selector.value = builder.String()
+		i++
+	} else {
+		for i < length && qualifier[i] != ' ' && qualifier[i] != ']' {
+			i++
+		}
+
+		if i == start {
+			return nil, false
+		}
+
+		selector.value = qualifier[start:i]
+	}
+
+	selector.hasValue = true
+	i = skipSpaces(qualifier, i)
+
+	if qualifier[i] == 'i' || qualifier[i] == 'I' {
+		selector.foldCase = true
+		i = skipSpaces(qualifier, i+1)
+	} else if qualifier[i] == 's' || qualifier[i] == 'S' {
+		i = skipSpaces(qualifier, i+1)
+	}
+
+	return selector, i == length-1
+}
+
+func isAttributeSelectorDelimiter(c byte) bool {
+	return c == ' ' || c == ']' || c == '=' || strings.IndexByte("~|^$*", c) != -1
+}
+
+func skipSpaces(query string, i int) int {
+	for i < len(query) && query[i] == ' ' {
+		i++
+	}
+
+	return i
+}
+
+func (s *attributeSelector) match(p *Parser, t *Tag) bool {
+	attr, ok := t.Attributes[p.normalizeName(s.name)]
+
+	if !ok {
+		return false
+	}
+
+	if !s.hasValue {
+		return true
+	}
+
+	value := s.value
+
+	if s.foldCase {
+		attr = strings.ToLower(attr)
+		value = strings.ToLower(value)
+	}
+
+	switch s.operator {
+	case "=":
+		return attr == value
+	case "~=":
+		return containsWord(attr, value)
+	case "|=":
+		return attr == value || strings.HasPrefix(attr, value+"-")
+	case "^=":
+		return value != "" && strings.HasPrefix(attr, value)
+	case "$=":
+		return value != "" && strings.HasSuffix(attr, value)
+	case "*=":
+		return value != "" && strings.Contains(attr, value)
+	}
+
+	return false
+}
+
+func containsWord(list string, word string) bool {
+	length := len(list)
+
+	if word == "" {
+		return false
+	}
+
+	for i := 0; i < length; {
+		for i < length && isSpace(list[i]) {
+			i++
+		}
+
+		start := i
+
+		for i < length && !isSpace(list[i]) {
+			i++
+		}
+
+		if list[start:i] == word {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,112 @@
+package parseur
+
+import "strings"
+
+// binds a prefix for use in selectors and xpath expressions, taking
+// precedence over the prefixes declared by the document
+func (p *Parser) RegisterNamespace(prefix string, uri string) {
+	if p.prefixes == nil {
+		p.prefixes = make(map[string]string)
+	}
+
+	p.prefixes[prefix] = uri
+}
+
+// parses a type selector with an optional namespace, ns|name, *|name, |name
+// or the escaped ns\:name
+func parseTypeSelector(selector string, i int, offset int, current *qualifier) (int, *SelectorError) {
+	name, i := readSelectorName(selector, i)
+	length := len(selector)
+
+	if i < length && selector[i] == '|' && (i+1 >= length || selector[i+1] != '=') {
+		current.namespace, current.namespaced = name, true
+
+		if name, i = readSelectorName(selector, i+1); name == "" {
+			return i, &SelectorError{Offset: offset + i, Reason: "missing name after '|'"}
+		}
+	} else if prefix, local, ok := strings.Cut(name, ":"); ok {
+		if prefix == "" || local == "" {
+			return i, &SelectorError{Offset: offset + i, Reason: "invalid namespace prefix"}
+		}
+
+		current.namespace, current.namespaced = prefix, true
+		name = local
+	}
+
+	current.value = name
+
+	return i, nil
+}
+
+func readSelectorName(selector string, i int) (string, int) {
+	length := len(selector)
+
+	if i < length && selector[i] == '*' {
+		return "*", i + 1
+	}
+
+	builder := strings.Builder{}
+
+	for i < length {
+		if selector[i] == '\\' && i+1 < length {
+			builder.WriteByte(selector[i+1])
+			i += 2
+			continue
+		}
+
+		if !isValidQualifierChar(selector[i]) {
+			break
+		}
+
+		builder.WriteByte(selector[i])
+		i++
+	}
+
+	return builder.String(), i
+}
+
+// the prefix resolves through the registered and declared namespaces, an
+// undeclared prefix only matches elements written with it
+func (p *Parser) inNamespace(t *Tag, prefix string) bool {
+	switch prefix {
+	case "*":
+		return true
+	case "":
+		return t.Namespace == "" && p.namespaceURI(t) == ""
+	}
+
+	uri, ok := p.prefixes[prefix]
+
+	if !ok {
+		prefix = p.normalizeName(prefix)
+		uri, ok = p.namespaces[prefix]
+	}
+
+	if !ok {
+		return t.Namespace == prefix
+	}
+
+	return p.namespaceURI(t) == uri
+}
+
+// resolves the element's prefix, or the default namespace if it has none,
+// through the nearest declaration in scope
+func (p *Parser) namespaceURI(t *Tag) string {
+	attribute := "xmlns"
+
+	if t.Namespace != "" {
+		attribute = "xmlns:" + t.Namespace
+	}
+
+	for tag := t; tag != nil; tag = tag.parent {
+		if uri, ok := tag.Attributes[attribute]; ok {
+			return uri
+		}
+	}
+
+	if t.Namespace != "" {
+		return p.namespaces[t.Namespace]
+	}
+
+	return ""
+}
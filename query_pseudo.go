@@ -0,0 +1,452 @@
+package parseur
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type pseudoSelector struct {
+	name      string
+	argument  string
+	a         int
+	b         int
+	selectors [][]selectorStep
+	text      string
+	pattern   *regexp.Regexp
+}
+
+var structuralPseudoMap = map[string]bool{
+	"first-child":      false,
+	"last-child":       false,
+	"only-child":       false,
+	"first-of-type":    false,
+	"last-of-type":     false,
+	"only-of-type":     false,
+	"empty":            false,
+	"root":             false,
+	"nth-child":        true,
+	"nth-last-child":   true,
+	"nth-of-type":      true,
+	"nth-last-of-type": true,
+}
+
+// pseudo-classes taking a selector list, the value marks relative selectors
+var logicalPseudoMap = map[string]bool{
+	"not":   false,
+	"is":    false,
+	"where": false,
+	"has":   true,
+}
+
+// pseudo-classes matching against the text InnerText reconstructs
+var textPseudoMap = map[string]struct{}{
+	"contains": {},
+	"has-text": {},
+	"matches":  {},
+}
+
+func skipPseudoSelector(query string, i int) int {
+	length := len(query)
+
+	for i += 1; i < length && (isValidQualifierChar(query[i])); i++ {
+	}
+
+	if i >= length || query[i] != '(' {
+		return i
+	}
+
+	depth := 0
+
+	for ; i < length; i++ {
+		switch query[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '"', '\'':
+			literal := query[i]
+
+			for i += 1; i < length && query[i] != literal; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+		}
+
+		if depth == 0 {
+			return i + 1
+		}
+	}
+
+	return length
+}
+
+func parsePseudoSelector(qualifier string, offset int) (*pseudoSelector, *SelectorError) {
+	selector := &pseudoSelector{name: qualifier[1:]}
+	open := strings.IndexByte(qualifier, '(')
+
+	if open != -1 {
+		if qualifier[len(qualifier)-1] != ')' {
+			return nil, &SelectorError{Offset: offset + open, Reason: "unterminated argument"}
+		}
+
+		selector.name = qualifier[1:open]
+		selector.argument = qualifier[open+1 : len(qualifier)-1]
+	}
+
+	if relative, ok := logicalPseudoMap[selector.name]; ok {
+		if open == -1 {
+			return nil, &SelectorError{Offset: offset, Reason: "missing argument to :" + selector.name}
+		}
+
+		var err *SelectorError
+		selector.selectors, err = parseSelectorList(selector.argument, offset+open+1, relative)
+
+		return selector, err
+	}
+
+	if _, ok := textPseudoMap[selector.name]; ok {
+		if open == -1 {
+			return nil, &SelectorError{Offset: offset, Reason: "missing argument to :" + selector.name}
+		}
+
+		return selector, selector.parseText(offset + open + 1)
+	}
+
+	hasArgument, ok := structuralPseudoMap[selector.name]
+
+	if !ok {
+		return nil, &SelectorError{Offset: offset, Reason: "unknown pseudo-class :" + selector.name}
+	}
+
+	if hasArgument != (open != -1) {
+		return nil, &SelectorError{Offset: offset, Reason: "unexpected argument to :" + selector.name}
+	}
+
+	if hasArgument {
+		if selector.a, selector.b, ok = parseNth(selector.argument); !ok {
+			return nil, &SelectorError{Offset: offset + open + 1, Reason: "invalid an+b expression"}
+		}
+	}
+
+	return selector, nil
+}
+
+// the argument is a string, quoted or not, or a /pattern/ with optional
+// i, m and s flags
+func (s *pseudoSelector) parseText(offset int) *SelectorError {
+	argument := strings.TrimSpace(s.argument)
+	offset += strings.Index(s.argument, argument)
+
+	if strings.HasPrefix(argument, "/") && s.name != "contains" {
+		end := strings.LastIndexByte(argument, '/')
+		flags := argument[end+1:]
+
+		if end == 0 || strings.Trim(flags, "ims") != "" {
+			return &SelectorError{Offset: offset, Reason: "invalid regular expression"}
+		}
+
+		argument = argument[1:end]
+
+		if flags != "" {
+			argument = "(?" + flags + ")" + argument
+		}
+	} else {
+		text, ok := unquoteSelectorString(argument)
+
+		if !ok {
+			return &SelectorError{Offset: offset, Reason: "unterminated string"}
+		}
+
+		if s.name != "matches" {
+			s.text = text
+
+			if s.name == "has-text" {
+				s.text = strings.ToLower(normalizeSpace(text))
+			}
+
+			return nil
+		}
+
+		argument = text
+	}
+
+	pattern, err := regexp.Compile(argument)
+
+	if err != nil {
+		return &SelectorError{Offset: offset, Reason: "invalid regular expression"}
+	}
+
+	s.pattern = pattern
+
+	return nil
+}
+
+func unquoteSelectorString(value string) (string, bool) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return value, true
+	}
+
+	length := len(value)
+
+	if length < 2 || value[length-1] != value[0] {
+		return "", false
+	}
+
+	builder := strings.Builder{}
+
+	for i := 1; i < length-1; i++ {
+		if value[i] == '\\' && i+1 < length-1 {
+			i++
+		}
+
+		builder.WriteByte(value[i])
+	}
+
+	return builder.String(), true
+}
+
+func normalizeSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// parses the an+b microsyntax used by the :nth-* pseudo-classes
+func parseNth(argument string) (int, int, bool) {
+	argument = strings.ToLower(strings.ReplaceAll(argument, " ", ""))
+
+	switch argument {
+	case "odd":
+		return 2, 1, true
+	case "even":
+		return 2, 0, true
+	case "":
+		return 0, 0, false
+	}
+
+	index := strings.IndexByte(argument, 'n')
+
+	if index == -1 {
+		b, err := strconv.Atoi(argument)
+		return 0, b, err == nil
+	}
+
+	a := 1
+
+	switch coefficient := argument[:index]; coefficient {
+	case "", "+":
+	case "-":
+		a = -1
+	default:
+		value, err := strconv.Atoi(coefficient)
+
+		if err != nil {
+			return 0, 0, false
+		}
+
+		a = value
+	}
+
+	if index == len(argument)-1 {
+		return a, 0, true
+	}
+
+	offset := argument[index+1:]
+
+	if offset[0] != '+' && offset[0] != '-' {
+		return 0, 0, false
+	}
+
+	b, err := strconv.Atoi(offset)
+
+	return a, b, err == nil
+}
+
+func (s *pseudoSelector) match(p *Parser, t *Tag) bool {
+	switch s.name {
+	case "not":
+		return !p.matchSelectorList(s.selectors, t)
+	case "is", "where":
+		return p.matchSelectorList(s.selectors, t)
+	case "has":
+		return p.matchRelativeSelectorList(s.selectors, t)
+	case "contains":
+		return strings.Contains(p.innerText(t), s.text)
+	case "matches":
+		return s.pattern.MatchString(p.innerText(t))
+	case "has-text":
+		if s.pattern != nil {
+			return s.pattern.MatchString(p.innerText(t))
+		}
+
+		return strings.Contains(strings.ToLower(normalizeSpace(p.innerText(t))), s.text)
+	case "root":
+		return t.parent != nil && t.parent.parent == nil
+	case "empty":
+		return len(t.Children) == 0 && t.Body.End <= t.Body.Start
+	}
+
+	if t.parent == nil {
+		return false
+	}
+
+	switch s.name {
+	case "first-child":
+		return t.Index() == 0
+	case "last-child":
+		return t.Index() == len(t.parent.Children)-1
+	case "only-child":
+		return len(t.parent.Children) == 1
+	case "first-of-type":
+		return t.typeIndex(false) == 1
+	case "last-of-type":
+		return t.typeIndex(true) == 1
+	case "only-of-type":
+		return t.typeIndex(false) == 1 && t.typeIndex(true) == 1
+	case "nth-child":
+		return matchNth(s.a, s.b, t.Index()+1)
+	case "nth-last-child":
+		return matchNth(s.a, s.b, len(t.parent.Children)-t.Index())
+	case "nth-of-type":
+		return matchNth(s.a, s.b, t.typeIndex(false))
+	case "nth-last-of-type":
+		return matchNth(s.a, s.b, t.typeIndex(true))
+	}
+
+	return false
+}
+
+func matchNth(a, b, position int) bool {
+	if a == 0 {
+		return position == b
+	}
+
+	n := position - b
+
+	return n%a == 0 && n/a >= 0
+}
+
+// 1-based position among the siblings sharing the tag's name, counted from
+// the end if reverse is set
+func (t *Tag) typeIndex(reverse bool) int {
+	position := 0
+	siblings := t.parent.Children
+	length := len(siblings)
+
+	for i := 0; i < length; i++ {
+		sibling := siblings[i]
+
+		if reverse {
+			sibling = siblings[length-1-i]
+		}
+
+		if sibling.Name == t.Name {
+			position++
+		}
+
+		if sibling == t {
+			return position
+		}
+	}
+
+	return -1
+}
+
+func (p *Parser) matchSelectorList(selectors [][]selectorStep, t *Tag) bool {
+	for _, steps := range selectors {
+		if p.matchSteps(steps, len(steps)-1, t, nil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) matchRelativeSelectorList(selectors [][]selectorStep, t *Tag) bool {
+	for _, steps := range selectors {
+		candidates := t.Children
+
+		if steps[0].combinator == '+' || steps[0].combinator == '~' {
+			candidates = t.followingSiblings()
+		}
+
+		if p.matchRelativeCandidates(steps, candidates, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) matchRelativeCandidates(steps []selectorStep, candidates []*Tag, scope *Tag) bool {
+	for _, candidate := range candidates {
+		if p.matchSteps(steps, len(steps)-1, candidate, scope) ||
+			p.matchRelativeCandidates(steps, candidate.Children, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches the tag against the compound selector at index k and walks the
+// combinators right to left, anchoring the first step to scope if given
+func (p *Parser) matchSteps(steps []selectorStep, k int, t *Tag, scope *Tag) bool {
+	if t == nil || t.parent == nil || !p.matchQualifiers(steps[k].qualifiers, t) {
+		return false
+	}
+
+	if k == 0 {
+		return scope == nil || isRelated(steps[0].combinator, scope, t)
+	}
+
+	switch steps[k].combinator {
+	case '>':
+		return p.matchSteps(steps, k-1, t.parent, scope)
+	case '+':
+		return p.matchSteps(steps, k-1, t.PrevSibling(), scope)
+	case '~':
+		for sibling := t.PrevSibling(); sibling != nil; sibling = sibling.PrevSibling() {
+			if p.matchSteps(steps, k-1, sibling, scope) {
+				return true
+			}
+		}
+	default:
+		for ancestor := t.parent; ancestor != nil; ancestor = ancestor.parent {
+			if p.matchSteps(steps, k-1, ancestor, scope) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isRelated(combinator byte, scope *Tag, t *Tag) bool {
+	switch combinator {
+	case '>':
+		return t.parent == scope
+	case '+':
+		return t.PrevSibling() == scope
+	case '~':
+		return t.parent == scope.parent && scope.Index() < t.Index()
+	default:
+		for ancestor := t.parent; ancestor != nil; ancestor = ancestor.parent {
+			if ancestor == scope {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *Tag) followingSiblings() []*Tag {
+	index := t.Index()
+
+	if index == -1 {
+		return nil
+	}
+
+	return t.parent.Children[index+1:]
+}
@@ -0,0 +1,480 @@
+package parseur
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+type RenderMode int
+
+const (
+	// writes the markup as it is in the body, which includes any edits
+	PreserveMarkup RenderMode = iota
+	// serializes the tree, quoting and escaping every attribute and text
+	// and closing every element that isn't void
+	NormalizeMarkup
+	// normalizes the markup and puts every block on its own indented line,
+	// text and inline elements keep sharing theirs
+	PrettyMarkup
+	// normalizes the markup, collapses whitespace and drops comments and
+	// the quotes attribute values don't need
+	MinifyMarkup
+)
+
+type RenderOptions struct {
+	Mode RenderMode
+	// the indent per level in PrettyMarkup, two spaces if empty
+	Indent string
+}
+
+// elements laid out in the flow of the text, they share the line of the
+// text around them
+var inlineTagsMap = map[string]struct{}{
+	"a":        {},
+	"abbr":     {},
+	"b":        {},
+	"bdi":      {},
+	"bdo":      {},
+	"big":      {},
+	"br":       {},
+	"button":   {},
+	"cite":     {},
+	"code":     {},
+	"data":     {},
+	"del":      {},
+	"dfn":      {},
+	"em":       {},
+	"font":     {},
+	"i":        {},
+	"img":      {},
+	"input":    {},
+	"ins":      {},
+	"kbd":      {},
+	"label":    {},
+	"mark":     {},
+	"meter":    {},
+	"output":   {},
+	"progress": {},
+	"q":        {},
+	"s":        {},
+	"samp":     {},
+	"select":   {},
+	"small":    {},
+	"span":     {},
+	"strike":   {},
+	"strong":   {},
+	"sub":      {},
+	"sup":      {},
+	"textarea": {},
+	"time":     {},
+	"tt":       {},
+	"u":        {},
+	"var":      {},
+	"wbr":      {},
+}
+
+// elements whose whitespace is significant, their content is never
+// reformatted
+var preformattedTagsMap = map[string]struct{}{
+	"pre":       {},
+	"listing":   {},
+	"plaintext": {},
+	"xmp":       {},
+	"textarea":  {},
+	"script":    {},
+	"style":     {},
+}
+
+type renderer struct {
+	parser  *Parser
+	options RenderOptions
+	out     *bufio.Writer
+	depth   int
+	// the current line has content
+	inLine bool
+	// whitespace was collapsed and is written in front of the next content
+	pending bool
+	// drops whitespace up to the next content, after a block's start tag
+	trim bool
+}
+
+func newRenderer(p *Parser, w io.Writer, options RenderOptions) *renderer {
+	if options.Mode == PrettyMarkup && options.Indent == "" {
+		options.Indent = "  "
+	}
+
+	if options.Mode == MinifyMarkup {
+		options.Indent = ""
+	}
+
+	return &renderer{parser: p, options: options, out: bufio.NewWriter(w)}
+}
+
+func (p *Parser) Render(w io.Writer) error {
+	return p.RenderWithOptions(w, RenderOptions{})
+}
+
+func (p *Parser) RenderWithOptions(w io.Writer, options RenderOptions) error {
+	r := newRenderer(p, w, options)
+
+	switch options.Mode {
+	case PreserveMarkup:
+		_, _ = r.out.Write(*p.body)
+	case NormalizeMarkup:
+		r.document()
+	default:
+		r.layoutDocument()
+	}
+
+	return r.out.Flush()
+}
+
+func (qt *QueryTag) Render(w io.Writer) error {
+	return qt.RenderWithOptions(w, RenderOptions{})
+}
+
+func (qt *QueryTag) RenderWithOptions(w io.Writer, options RenderOptions) error {
+	if qt.Tag == nil {
+		return nil
+	}
+
+	if qt.Tag == qt.parser.root {
+		return qt.parser.RenderWithOptions(w, options)
+	}
+
+	r := newRenderer(qt.parser, w, options)
+
+	switch options.Mode {
+	case PreserveMarkup:
+		_, _ = r.out.Write((*qt.parser.body)[qt.Tag.Tag.Start:qt.Tag.Tag.End])
+	case NormalizeMarkup:
+		r.element(qt.Tag)
+	default:
+		r.layout(qt.Tag.parent, []*Node{{Type: ElementNode, Tag: qt.Tag, Offset: qt.Tag.Tag, Data: qt.Tag.Body}})
+		r.newline()
+	}
+
+	return r.out.Flush()
+}
+
+// the prolog in front of the root's body, a doctype or xml declaration, is
+// written as it is
+func (r *renderer) document() {
+	root := r.parser.root
+	_, _ = r.out.Write((*r.parser.body)[:root.Body.Start])
+
+	for _, node := range r.documentNodes() {
+		r.node(root, node)
+	}
+}
+
+func (r *renderer) documentNodes() []*Node {
+	root := r.parser.root
+	nodes := make([]*Node, 0)
+
+	for _, node := range r.parser.contentNodes(root) {
+		if node.Offset.Start >= root.Body.Start || node.Type == ElementNode {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+func (r *renderer) node(parent *Tag, node *Node) {
+	p := r.parser
+
+	switch node.Type {
+	case ElementNode:
+		r.element(node.Tag)
+	case TextNode:
+		r.text(parent, node.Data)
+	case CommentNode:
+		_, _ = r.out.WriteString("<!--")
+		_, _ = r.out.WriteString(p.value(node.Data.Start, node.Data.End))
+		_, _ = r.out.WriteString("-->")
+	case CDataNode:
+		_, _ = r.out.WriteString("<![CDATA[")
+		_, _ = r.out.WriteString(p.value(node.Data.Start, node.Data.End))
+		_, _ = r.out.WriteString("]]>")
+	default:
+		_, _ = r.out.WriteString(p.value(node.Offset.Start, node.Offset.End))
+	}
+}
+
+func (r *renderer) text(parent *Tag, data Offset) {
+	_, _ = r.out.WriteString(r.content(parent, data))
+}
+
+// the text as it is written, escaped unless the parent holds raw text
+func (r *renderer) content(parent *Tag, data Offset) string {
+	p := r.parser
+	escapable, rawText := p.rawText(parent)
+
+	switch {
+	case rawText && (!escapable || p.rawEntities):
+		return p.value(data.Start, data.End)
+	case rawText:
+		return rawTextEscaper.Replace(p.text(parent, data.Start, data.End))
+	}
+
+	builder := strings.Builder{}
+
+	for _, segment := range r.withoutEndTags(data) {
+		if p.rawEntities {
+			builder.WriteString(p.value(segment.Start, segment.End))
+		} else {
+			builder.WriteString(textEscaper.Replace(p.text(parent, segment.Start, segment.End)))
+		}
+	}
+
+	return builder.String()
+}
+
+// an end tag left in text matched no element, it is dropped the way an
+// html serializer never writes one
+func (r *renderer) withoutEndTags(data Offset) []Offset {
+	body := *r.parser.body
+	segments := make([]Offset, 0, 1)
+	start := data.Start
+
+	for i := data.Start; i+2 < data.End; i++ {
+		if body[i] != '<' || body[i+1] != '/' || !r.parser.isValidTagStart(i+2) {
+			continue
+		}
+
+		end := bytes.IndexByte(body[i+2:data.End], '>')
+
+		if end == -1 {
+			break
+		}
+
+		segments = append(segments, Offset{start, i})
+		start = i + 2 + end + 1
+		i = start - 1
+	}
+
+	return append(segments, Offset{start, data.End})
+}
+
+func (r *renderer) element(t *Tag) {
+	start, empty := r.startTag(t)
+	_, _ = r.out.Write(start)
+
+	if empty {
+		return
+	}
+
+	for _, node := range r.parser.contentNodes(t) {
+		r.node(t, node)
+	}
+
+	_, _ = r.out.WriteString("</" + t.qualifiedName() + ">")
+}
+
+// the normalized start tag, and whether the element has no content
+func (r *renderer) startTag(t *Tag) ([]byte, bool) {
+	p := r.parser
+	unquoted := r.options.Mode == MinifyMarkup && !p.xml
+	start := p.renderStartTag(t, (*p.body)[t.Tag.Start:t.startTagEnd()], unquoted)
+	_, void := selfclosingTagsMap[t.Name]
+
+	return start, (void && !p.xml) || bytes.HasSuffix(start, []byte("/>"))
+}
+
+func (r *renderer) layoutDocument() {
+	root := r.parser.root
+	prolog := bytes.TrimSpace((*r.parser.body)[:root.Body.Start])
+
+	if len(prolog) != 0 {
+		r.write(string(prolog))
+		r.newline()
+	}
+
+	r.layout(root, r.documentNodes())
+	r.newline()
+}
+
+// runs of text and inline elements share a line, every other node gets
+// one of its own
+func (r *renderer) layout(parent *Tag, nodes []*Node) {
+	for _, node := range nodes {
+		if r.flows(node) {
+			r.inline(parent, node)
+			continue
+		}
+
+		r.newline()
+
+		if node.Type == ElementNode {
+			r.block(node.Tag)
+		} else {
+			r.write(r.parser.value(node.Offset.Start, node.Offset.End))
+		}
+
+		r.newline()
+	}
+}
+
+func (r *renderer) block(t *Tag) {
+	start, empty := r.startTag(t)
+	r.write(string(start))
+
+	if empty {
+		return
+	}
+
+	nodes := r.parser.contentNodes(t)
+
+	switch {
+	case r.preformatted(t):
+		for _, node := range nodes {
+			r.node(t, node)
+		}
+	case r.flowsAll(nodes):
+		r.trim = true
+
+		for _, node := range nodes {
+			r.inline(t, node)
+		}
+	default:
+		r.newline()
+		r.depth++
+		r.layout(t, nodes)
+		r.newline()
+		r.depth--
+	}
+
+	r.pending = false
+	r.write("</" + t.qualifiedName() + ">")
+}
+
+func (r *renderer) inline(parent *Tag, node *Node) {
+	switch node.Type {
+	case ElementNode:
+	case TextNode:
+		r.words(r.content(parent, node.Data))
+		return
+	case CommentNode:
+		// only flows when it's dropped
+		return
+	default:
+		r.write(r.parser.value(node.Offset.Start, node.Offset.End))
+		return
+	}
+
+	t := node.Tag
+	start, empty := r.startTag(t)
+	r.write(string(start))
+
+	if empty {
+		return
+	}
+
+	for _, child := range r.parser.contentNodes(t) {
+		if r.preformatted(t) {
+			r.node(t, child)
+		} else {
+			r.inline(t, child)
+		}
+	}
+
+	// whitespace in front of the end tag moves behind it
+	_, _ = r.out.WriteString("</" + t.qualifiedName() + ">")
+}
+
+// collapses every run of whitespace into a single space
+func (r *renderer) words(text string) {
+	start := 0
+
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && !isSpace(text[i]) {
+			continue
+		}
+
+		if i > start {
+			r.write(text[start:i])
+		}
+
+		if i < len(text) {
+			r.space()
+		}
+
+		start = i + 1
+	}
+}
+
+func (r *renderer) flows(node *Node) bool {
+	switch node.Type {
+	case ElementNode:
+		return r.isInline(node.Tag)
+	case CommentNode:
+		return r.options.Mode == MinifyMarkup
+	case TextNode, CDataNode:
+		return true
+	}
+
+	return false
+}
+
+func (r *renderer) flowsAll(nodes []*Node) bool {
+	for _, node := range nodes {
+		if !r.flows(node) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inline elements holding a block are laid out as blocks
+func (r *renderer) isInline(t *Tag) bool {
+	if _, ok := inlineTagsMap[t.Name]; !ok || r.parser.xml || t.Namespace != "" {
+		return false
+	}
+
+	for _, child := range t.Children {
+		if !r.isInline(child) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *renderer) preformatted(t *Tag) bool {
+	_, ok := preformattedTagsMap[t.Name]
+
+	return ok && !r.parser.xml && t.Namespace == ""
+}
+
+// writes content, indented at the start of a line and separated by the
+// pending whitespace otherwise
+func (r *renderer) write(s string) {
+	if !r.inLine {
+		_, _ = r.out.WriteString(strings.Repeat(r.options.Indent, r.depth))
+		r.inLine = true
+	} else if r.pending {
+		_ = r.out.WriteByte(' ')
+	}
+
+	r.pending, r.trim = false, false
+	_, _ = r.out.WriteString(s)
+}
+
+func (r *renderer) space() {
+	if r.inLine && !r.trim {
+		r.pending = true
+	}
+}
+
+// ends the current line, whitespace at the end of a line is dropped
+func (r *renderer) newline() {
+	if r.inLine && r.options.Mode == PrettyMarkup {
+		_ = r.out.WriteByte('\n')
+	}
+
+	r.inLine, r.pending = false, false
+}
@@ -0,0 +1,181 @@
+package parseur
+
+import (
+	"fmt"
+	"log"
+)
+
+type Selector struct {
+	source    string
+	selectors [][]selectorStep
+}
+
+type SelectorError struct {
+	Selector string
+	Offset   int
+	Reason   string
+}
+
+type selectorStep struct {
+	combinator byte
+	qualifiers []*qualifier
+}
+
+func (e *SelectorError) Error() string {
+	return fmt.Sprintf("invalid selector '%s' at offset %d: %s", e.Selector, e.Offset, e.Reason)
+}
+
+// compiles a selector list once so it can be run against any number of
+// parsers and subtrees, a leading combinator is relative to the scope
+func Compile(selector string) (*Selector, error) {
+	selectors, err := parseSelectorList(selector, 0, true)
+
+	if err != nil {
+		err.Selector = selector
+		return nil, err
+	}
+
+	return &Selector{source: selector, selectors: selectors}, nil
+}
+
+func MustCompile(selector string) *Selector {
+	s, err := Compile(selector)
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return s
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+func (s *Selector) Match(qt *QueryTag) bool {
+	if qt.Tag == nil {
+		return false
+	}
+
+	for _, steps := range s.selectors {
+		if qt.parser.matchSteps(steps, len(steps)-1, qt.Tag, qt.parser.root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitSelectorList(list string) []string {
+	selectors := make([]string, 0)
+	length := len(list)
+	depth := 0
+	start := 0
+
+	for i := 0; i < length; i++ {
+		switch list[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case '"', '\'':
+			literal := list[i]
+
+			for i += 1; i < length && list[i] != literal; i++ {
+				if list[i] == '\\' {
+					i++
+				}
+			}
+		case ',':
+			if depth == 0 {
+				selectors = append(selectors, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(selectors, list[start:])
+}
+
+// offset is the position of list within the selector being compiled
+func parseSelectorList(list string, offset int, relative bool) ([][]selectorStep, *SelectorError) {
+	selectors := make([][]selectorStep, 0)
+
+	for _, selector := range splitSelectorList(list) {
+		steps, err := parseSelectorSteps(selector, offset, relative)
+
+		if err != nil {
+			return nil, err
+		}
+
+		selectors = append(selectors, steps)
+		offset += len(selector) + 1
+	}
+
+	return selectors, nil
+}
+
+func isCombinator(c byte) bool {
+	return c == '>' || c == '+' || c == '~'
+}
+
+// splits a complex selector into compound selectors and the combinators
+// joining each of them to its predecessor
+func parseSelectorSteps(selector string, offset int, relative bool) ([]selectorStep, *SelectorError) {
+	steps := make([]selectorStep, 0)
+	length := len(selector)
+	combinator := byte(0)
+
+	for i := skipSpaces(selector, 0); i < length; {
+		if isCombinator(selector[i]) {
+			if (combinator != 0 && combinator != ' ') || (len(steps) == 0 && !relative) {
+				return nil, unexpectedCharacter(selector, offset, i)
+			}
+
+			combinator = selector[i]
+			i = skipSpaces(selector, i+1)
+			continue
+		}
+
+		if combinator == 0 && len(steps) > 0 {
+			return nil, unexpectedCharacter(selector, offset, i)
+		}
+
+		start := i
+		qualifiers, end, err := parseQualifiers(selector, i, offset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i = end; i == start {
+			return nil, unexpectedCharacter(selector, offset, i)
+		}
+
+		if combinator == 0 && relative && len(steps) == 0 {
+			combinator = ' '
+		}
+
+		steps = append(steps, selectorStep{combinator, qualifiers})
+		combinator = 0
+
+		if i < length && selector[i] == ' ' {
+			combinator = ' '
+			i = skipSpaces(selector, i)
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, &SelectorError{Offset: offset + length, Reason: "empty selector"}
+	}
+
+	if combinator != 0 && combinator != ' ' {
+		return nil, &SelectorError{Offset: offset + length, Reason: "missing selector after combinator"}
+	}
+
+	return steps, nil
+}
+
+func unexpectedCharacter(selector string, offset int, i int) *SelectorError {
+	return &SelectorError{Offset: offset + i, Reason: fmt.Sprintf("unexpected character '%c'", selector[i])}
+}
@@ -0,0 +1,72 @@
+package parseur
+
+import (
+	"bufio"
+	"io"
+)
+
+const defaultChunkSize = 64000
+
+// parses the data read from r as it arrives, calling the hook between chunks
+// like FetchParseAsync does for responses, and returns once r is exhausted or
+// a hook stopped the parser. the input is transcoded to utf-8 like fetched
+// pages
+func NewStreamParser(r io.Reader, options Options) (*Parser, error) {
+	chunkSize := options.ChunkSize
+
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	reader, _ := decodingReader(bufio.NewReader(r), "")
+	data := make([]byte, 0, 4*chunkSize)
+	options.Async = true
+
+	p := NewParserWithOptions(&data, options)
+	_, err := p.stream(&data, reader, chunkSize)
+
+	return p, err
+}
+
+// feeds an async parser until the reader is exhausted and waits for it to
+// finish, the body is sent once more and DataChan closed to complete it. a
+// read error ends the body where it occurred
+func (p *Parser) stream(data *[]byte, r io.Reader, chunkSize int) (*[]byte, error) {
+	buf := make([]byte, chunkSize)
+	length := 0
+	var err error
+
+	for !p.Done {
+		var n int
+		n, err = r.Read(buf)
+
+		// the last chunk may arrive together with io.EOF
+		if n > 0 {
+			data = merge(data, &buf, length, n)
+			length += n
+		}
+
+		if err != nil {
+			break
+		}
+
+		select {
+		case p.DataChan <- data:
+		default:
+		}
+	}
+
+	// a hook may have stopped the parser before the body was complete
+	select {
+	case p.DataChan <- data:
+		close(p.DataChan)
+		<-p.ParseComplete
+	case <-p.ParseComplete:
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return data, err
+}
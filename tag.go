@@ -1,10 +1,94 @@
 package parseur
 
+import "strings"
+
 type Tag struct {
 	Name       string
 	Namespace  string
 	Children   []*Tag
+	Nodes      []*Node
 	Attributes map[string]string
 	Body       Offset
 	Tag        Offset
+	parent     *Tag
+	parser     *Parser
+	// the markup of a detached tree, held by its top tag
+	fragment *[]byte
+}
+
+func (t *Tag) Parent() *Tag {
+	return t.parent
+}
+
+// line and column of the start tag
+func (t *Tag) Position() Position {
+	return t.parser.Position(t.Tag.Start)
+}
+
+// line and column just past the end tag
+func (t *Tag) EndPosition() Position {
+	return t.parser.Position(t.Tag.End)
+}
+
+func (t *Tag) Index() int {
+	if t.parent == nil {
+		return -1
+	}
+
+	for i, child := range t.parent.Children {
+		if child == t {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (t *Tag) NextSibling() *Tag {
+	index := t.Index()
+
+	if index == -1 || index+1 >= len(t.parent.Children) {
+		return nil
+	}
+
+	return t.parent.Children[index+1]
+}
+
+func (t *Tag) PrevSibling() *Tag {
+	index := t.Index()
+
+	if index < 1 {
+		return nil
+	}
+
+	return t.parent.Children[index-1]
+}
+
+func (t *Tag) Ancestors() []*Tag {
+	ancestors := make([]*Tag, 0)
+
+	for parent := t.parent; parent != nil; parent = parent.parent {
+		ancestors = append(ancestors, parent)
+	}
+
+	return ancestors
+}
+
+func (t *Tag) hasAttributeFold(name string) bool {
+	for key := range t.Attributes {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the name as written in the document, including the namespace prefix
+func (t *Tag) qualifiedName() string {
+	if t.Namespace == "" {
+		return t.Name
+	}
+
+	return t.Namespace + ":" + t.Name
 }
@@ -0,0 +1,452 @@
+package parseur
+
+import (
+	"bytes"
+	"io"
+)
+
+type TokenType int
+
+const (
+	StartTagToken TokenType = iota
+	EndTagToken
+	SelfClosingTagToken
+	TextToken
+	CommentToken
+	DoctypeToken
+	CDataToken
+	ProcessingInstructionToken
+)
+
+type TokenAttribute struct {
+	Name  []byte
+	Value []byte
+}
+
+// the slices point into the tokenizer's buffer and are only valid until the
+// next call to Next, attribute values and text are not unescaped
+type Token struct {
+	Type       TokenType
+	Name       []byte
+	Data       []byte
+	Raw        []byte
+	Attributes []TokenAttribute
+	Offset     Offset
+}
+
+const tokenizerChunkSize = 4096
+
+// yields the markup of a document as a flat sequence of tokens without
+// building a tree, only the current token is kept in memory
+type Tokenizer struct {
+	scanner    *Parser
+	reader     io.Reader
+	buffer     []byte
+	base       int
+	index      int
+	eof        bool
+	xml        bool
+	err        error
+	rawText    string
+	name       Offset
+	data       Offset
+	attributes []Offset
+	token      Token
+}
+
+func NewTokenizer(r io.Reader) *Tokenizer {
+	t := &Tokenizer{reader: r, buffer: make([]byte, 0, tokenizerChunkSize)}
+
+	// the parser's scanning helpers run over the buffered window
+	t.scanner = &Parser{body: &t.buffer}
+	t.scanner.InBound = t.inBound
+
+	return t
+}
+
+// advances to the next token, returns false at the end of the input or on a
+// read error
+func (t *Tokenizer) Next() bool {
+	t.compact()
+
+	if !t.inBound(t.index) {
+		return false
+	}
+
+	start := t.index
+	end := -1
+	t.reset()
+
+	if t.rawText != "" {
+		end = t.scanRawText(start)
+		t.rawText = ""
+
+		if end == start {
+			end = -1
+		}
+	}
+
+	if end == -1 && t.buffer[start] == '<' {
+		end = t.scanMarkup(start)
+	}
+
+	if end == -1 {
+		t.reset()
+		end = t.scanText(start)
+	}
+
+	t.index = end
+	t.emit(start, end)
+
+	return true
+}
+
+func (t *Tokenizer) reset() {
+	t.name, t.data = Offset{}, Offset{}
+	t.attributes = t.attributes[:0]
+}
+
+func (t *Tokenizer) Token() *Token {
+	return &t.token
+}
+
+func (t *Tokenizer) Err() error {
+	return t.err
+}
+
+// reads until index is buffered, the scanner calls it the way the parser
+// waits for data in async mode
+func (t *Tokenizer) inBound(index int) bool {
+	for index >= len(t.buffer) && !t.eof {
+		t.read()
+	}
+
+	return index < len(t.buffer)
+}
+
+func (t *Tokenizer) read() {
+	if len(t.buffer) == cap(t.buffer) {
+		grown := make([]byte, len(t.buffer), 2*cap(t.buffer))
+		copy(grown, t.buffer)
+		t.buffer = grown
+	}
+
+	n, err := t.reader.Read(t.buffer[len(t.buffer):cap(t.buffer)])
+	t.buffer = t.buffer[:len(t.buffer)+n]
+
+	if err != nil {
+		t.eof = true
+
+		if err != io.EOF {
+			t.err = err
+		}
+	}
+}
+
+// drops the consumed part of the buffer once it makes up half of it
+func (t *Tokenizer) compact() {
+	if t.index == 0 || t.index < cap(t.buffer)/2 {
+		return
+	}
+
+	n := copy(t.buffer, t.buffer[t.index:])
+	t.buffer = t.buffer[:n]
+	t.base += t.index
+	t.index = 0
+}
+
+// slices are only taken once the token is complete, reading may move the
+// buffer while it is scanned
+func (t *Tokenizer) emit(start, end int) {
+	t.token.Raw = t.buffer[start:end]
+	t.token.Offset = Offset{t.base + start, t.base + end}
+	t.token.Name = t.slice(t.name)
+	t.token.Data = t.slice(t.data)
+	t.token.Attributes = t.token.Attributes[:0]
+
+	for i := 0; i < len(t.attributes); i += 2 {
+		t.token.Attributes = append(t.token.Attributes, TokenAttribute{
+			Name:  t.slice(t.attributes[i]),
+			Value: t.slice(t.attributes[i+1]),
+		})
+	}
+
+	if t.token.Type == TextToken {
+		t.token.Data = t.token.Raw
+	}
+}
+
+func (t *Tokenizer) slice(offset Offset) []byte {
+	if offset.End <= offset.Start {
+		return nil
+	}
+
+	return t.buffer[offset.Start:offset.End]
+}
+
+// text runs up to the next '<' that starts markup, a stray '<' is text
+func (t *Tokenizer) scanText(start int) int {
+	t.token.Type = TextToken
+	index := start + 1
+
+	for {
+		for t.inBound(index) && t.buffer[index] != '<' {
+			index++
+		}
+
+		if !t.inBound(index + 1) {
+			return len(t.buffer)
+		}
+
+		if t.startsMarkup(index) {
+			return index
+		}
+
+		index++
+	}
+}
+
+func (t *Tokenizer) startsMarkup(index int) bool {
+	c := t.buffer[index+1]
+
+	return c == '/' || c == '!' || c == '?' || t.scanner.isValidTagStart(index+1)
+}
+
+func (t *Tokenizer) scanMarkup(start int) int {
+	if !t.inBound(start + 1) {
+		return -1
+	}
+
+	switch c := t.buffer[start+1]; {
+	case c == '!':
+		if end := t.scanner.consumeComment(start); end != -1 {
+			return t.scanComment(start, end)
+		}
+
+		if end := t.scanner.consumeCData(start); end != -1 {
+			return t.scanSection(start, end, CDataToken, t.scanner.sectionData(start, end, 9, "]]>"))
+		}
+
+		return t.scanDeclaration(start, DoctypeToken)
+	case c == '?':
+		if bytes.HasPrefix(t.buffer[start:], []byte("<?xml")) && t.base+start == 0 {
+			t.xml = true
+			t.scanner.xml = true
+		}
+
+		if end := t.scanner.consumeProcessingInstruction(start); end != -1 {
+			return t.scanSection(start, end, ProcessingInstructionToken, t.scanner.sectionData(start, end, 2, "?>"))
+		}
+
+		return t.scanDeclaration(start, CommentToken)
+	case c == '/':
+		return t.scanEndTag(start)
+	case t.scanner.isValidTagStart(start + 1):
+		return t.scanStartTag(start)
+	}
+
+	return -1
+}
+
+func (t *Tokenizer) scanComment(start, end int) int {
+	t.token.Type = CommentToken
+	t.data = Offset{start + 4, end}
+
+	if bytes.HasSuffix(t.buffer[start:end], []byte("-->")) {
+		t.data.End = max(start+4, end-3)
+	}
+
+	return end
+}
+
+// cdata sections and processing instructions, data is the content between
+// their delimiters
+func (t *Tokenizer) scanSection(start, end int, tokenType TokenType, data Offset) int {
+	t.token.Type = tokenType
+	t.data = data
+
+	return end
+}
+
+// doctypes and other <! or <? declarations run up to the next '>'
+func (t *Tokenizer) scanDeclaration(start int, tokenType TokenType) int {
+	t.token.Type = tokenType
+	index := start + 2
+
+	for t.inBound(index) && t.buffer[index] != '>' {
+		index++
+	}
+
+	t.data = Offset{start + 2, index}
+
+	if tokenType == CommentToken && index > start+2 && t.buffer[index-1] == '?' {
+		t.data.End--
+	}
+
+	return min(index+1, len(t.buffer))
+}
+
+func (t *Tokenizer) scanName(index int) int {
+	start := index
+
+	for t.inBound(index) && (t.scanner.isValidTagChar(index) || t.buffer[index] == ':') {
+		index++
+	}
+
+	t.name = Offset{start, index}
+
+	return index
+}
+
+func (t *Tokenizer) scanEndTag(start int) int {
+	if !t.inBound(start+2) || !t.scanner.isValidTagStart(start+2) {
+		return -1
+	}
+
+	t.token.Type = EndTagToken
+	index := t.scanName(start + 2)
+
+	for t.inBound(index) && t.buffer[index] != '>' {
+		index++
+	}
+
+	if !t.inBound(index) {
+		return -1
+	}
+
+	return index + 1
+}
+
+func (t *Tokenizer) scanStartTag(start int) int {
+	t.token.Type = StartTagToken
+	index := t.scanName(start + 1)
+
+	for {
+		index = t.scanner.skipWhitespace(index)
+
+		// a tag cut off by the end of the input is text
+		if index == -1 || !t.inBound(index) {
+			return -1
+		}
+
+		if t.scanner.isAttributesEnd(index) {
+			break
+		}
+
+		if t.buffer[index] == '/' || t.buffer[index] == '=' {
+			index++
+			continue
+		}
+
+		if index = t.scanAttribute(index); index == -1 {
+			return -1
+		}
+	}
+
+	if t.buffer[index] != '>' {
+		t.token.Type = SelfClosingTagToken
+		index++
+	}
+
+	if t.token.Type == StartTagToken && !t.xml {
+		t.rawText = rawTextName(t.slice(t.name))
+	}
+
+	return index + 1
+}
+
+func (t *Tokenizer) scanAttribute(index int) int {
+	name := Offset{index, index}
+
+	for t.inBound(name.End) && t.scanner.isAttributeNameChar(name.End) {
+		name.End++
+	}
+
+	value := Offset{name.End, name.End}
+	index = t.scanner.skipWhitespace(name.End)
+
+	if index == -1 || !t.inBound(index) {
+		return -1
+	}
+
+	if t.buffer[index] != '=' {
+		t.attributes = append(t.attributes, name, value)
+		return index
+	}
+
+	if index = t.scanner.skipWhitespace(index + 1); index == -1 || !t.inBound(index) {
+		return -1
+	}
+
+	if quote := t.buffer[index]; quote == '"' || quote == '\'' {
+		value.Start = index + 1
+
+		for value.End = value.Start; t.inBound(value.End) && t.buffer[value.End] != quote; {
+			value.End++
+		}
+
+		if !t.inBound(value.End) {
+			return -1
+		}
+
+		index = value.End + 1
+	} else {
+		value.Start = index
+
+		for value.End = index; t.inBound(value.End) && !t.scanner.isWhitespace(value.End) && t.buffer[value.End] != '>'; {
+			value.End++
+		}
+
+		index = value.End
+	}
+
+	t.attributes = append(t.attributes, name, value)
+
+	return index
+}
+
+// the body of a raw text element runs up to its end tag, which is left for
+// the next token
+func (t *Tokenizer) scanRawText(start int) int {
+	t.token.Type = TextToken
+	index := start
+	length := len(t.rawText) + 2
+
+	for t.rawText != "plaintext" && t.inBound(index) {
+		for t.inBound(index) && t.buffer[index] != '<' {
+			index++
+		}
+
+		if !t.inBound(index + length) {
+			break
+		}
+
+		isRawTextEnd := t.buffer[index+1] == '/' &&
+			bytes.EqualFold(t.buffer[index+2:index+length], []byte(t.rawText))
+
+		if isRawTextEnd {
+			if k := t.scanner.skipWhitespace(index + length); k != -1 && t.buffer[k] == '>' {
+				return index
+			}
+		}
+
+		index++
+	}
+
+	// unterminated, the rest of the input is text
+	for t.inBound(index) {
+		index = len(t.buffer)
+	}
+
+	return index
+}
+
+func rawTextName(name []byte) string {
+	for rawText := range rawTextTagsMap {
+		if bytes.EqualFold(name, []byte(rawText)) {
+			return rawText
+		}
+	}
+
+	return ""
+}
@@ -17,6 +17,8 @@ type Request struct {
 	Hook           *func(p *Parser)
 	*context.CancelFunc
 	Method string
+	// the detected charset of a parsed response, its Data is utf-8
+	Encoding string
 }
 
 type WebClient struct {
@@ -41,7 +43,7 @@ func NewClient() *WebClient {
 			Jar: jar,
 		},
 		jar:       jar,
-		chunkSize: 64000,
+		chunkSize: defaultChunkSize,
 		userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
 	}
 }
@@ -143,6 +145,21 @@ func (c *WebClient) FetchParseSync(request *Request) (p *Parser, err error) {
 		return nil, nil
 	}
 
+	var contentType string
+
+	if request.ResponseHeader != nil {
+		contentType = request.ResponseHeader.Get("Content-Type")
+	}
+
+	data, encoding, decodeErr := DecodeToUTF8(*request.Data, contentType)
+
+	if err == nil {
+		err = decodeErr
+	}
+
+	request.Data = &data
+	request.Encoding = encoding
+
 	parser := NewParser(request.Data, false, nil)
 	parser.Request = request
 
@@ -167,10 +184,11 @@ func (c *WebClient) prepare(request *Request) (*http.Request, error) {
 }
 
 func merge(old *[]byte, new *[]byte, length int, additionalLength int) *[]byte {
+	// the parser may still be reading old, so it always gets a new header
 	if cap(*old) > length+additionalLength {
-		*old = append(*old, (*new)[:additionalLength]...)
+		extended := append(*old, (*new)[:additionalLength]...)
 
-		return old
+		return &extended
 	}
 
 	newLength := length + additionalLength
@@ -201,50 +219,23 @@ func (c *WebClient) FetchParseAsync(request *Request) (p *Parser, err error) {
 		return nil, err
 	}
 
-	buf := make([]byte, c.chunkSize)
 	data := make([]byte, 0, 4*c.chunkSize)
-	dataPtr := &data
-	reader := bufio.NewReader(resp.Body)
-	length := 0
+	request.ResponseHeader = &resp.Header
+	reader, encoding := decodingReader(bufio.NewReader(resp.Body), resp.Header.Get("Content-Type"))
+	request.Encoding = encoding
 
-	p = NewParser(dataPtr, true, request.Hook)
+	p = NewParser(&data, true, request.Hook)
 	p.Request = request
-	p.length = 0
-	var n = 0
-
-	for !p.Done {
-		n, err = reader.Read(buf)
-
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return nil, err
-		}
-
-		if n > 0 {
-			dataPtr = merge(dataPtr, &buf, length, n)
-		}
-
-		length += n
 
-		select {
-		case p.DataChan <- dataPtr:
-		default:
-		}
-	}
-
-	err = resp.Body.Close()
+	dataPtr, err := p.stream(&data, reader, c.chunkSize)
+	closeErr := resp.Body.Close()
 	(*request.CancelFunc)()
 
-	if !p.Done {
-		*p.Complete = true
-		p.DataChan <- dataPtr
-		<-p.ParseComplete
+	if err != nil {
+		return nil, err
 	}
 
 	request.Data = dataPtr
 
-	return p, err
+	return p, closeErr
 }
@@ -0,0 +1,578 @@
+package parseur
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+)
+
+type XPathError struct {
+	Expr   string
+	Offset int
+	Reason string
+}
+
+func (e *XPathError) Error() string {
+	return fmt.Sprintf("invalid xpath '%s' at offset %d: %s", e.Expr, e.Offset, e.Reason)
+}
+
+// the value of an expression, a node-set, string, number or boolean
+type XPathResult struct {
+	value     any
+	evaluator *xpathEvaluator
+}
+
+type xpathNodeKind int
+
+const (
+	xpathRootNode xpathNodeKind = iota
+	xpathElementNode
+	xpathAttributeNode
+	xpathTextNode
+	xpathCommentNode
+	xpathProcessingInstructionNode
+)
+
+// tag is the element itself or the element owning an attribute, text or
+// comment, offset and data locate text and comments in the body
+type xpathNode struct {
+	kind   xpathNodeKind
+	tag    *Tag
+	name   string
+	offset Offset
+	data   Offset
+	order  int
+}
+
+type xpathContext struct {
+	node     xpathNode
+	position int
+	size     int
+}
+
+type xpathEvaluator struct {
+	parser *Parser
+	expr   string
+}
+
+func (p *Parser) XPath(expr string) (*XPathResult, error) {
+	return p.evaluateXPath(expr, p.root)
+}
+
+func (qt *QueryTag) XPath(expr string) (*XPathResult, error) {
+	if qt.Tag == nil {
+		if _, err := parseXPath(expr); err != nil {
+			return nil, err
+		}
+
+		return &XPathResult{value: []xpathNode{}}, nil
+	}
+
+	return qt.parser.evaluateXPath(expr, qt.Tag)
+}
+
+func (p *Parser) evaluateXPath(expr string, context *Tag) (result *XPathResult, err error) {
+	compiled, err := parseXPath(expr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	x := &xpathEvaluator{parser: p, expr: expr}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			xpathErr, ok := recovered.(*XPathError)
+
+			if !ok {
+				panic(recovered)
+			}
+
+			result, err = nil, xpathErr
+		}
+	}()
+
+	value := compiled.evaluate(x, xpathContext{node: x.tagNode(context), position: 1, size: 1})
+
+	return &XPathResult{value: value, evaluator: x}, nil
+}
+
+func (x *xpathEvaluator) fail(reason string) {
+	panic(&XPathError{x.expr, 0, reason})
+}
+
+func (r *XPathResult) IsNodeSet() bool {
+	_, ok := r.value.([]xpathNode)
+	return ok
+}
+
+// the elements of a node-set result in document order
+func (r *XPathResult) Tags() *[]*QueryTag {
+	nodes, _ := r.value.([]xpathNode)
+	tags := make([]*QueryTag, 0)
+
+	for _, node := range nodes {
+		if node.kind == xpathElementNode {
+			tags = append(tags, &QueryTag{node.tag, r.evaluator.parser})
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return &tags
+}
+
+func (r *XPathResult) First() *QueryTag {
+	tags := r.Tags()
+
+	if tags == nil {
+		return &QueryTag{}
+	}
+
+	return (*tags)[0]
+}
+
+// the string-value of every node of a node-set result, or the string value
+// of a scalar result
+func (r *XPathResult) Strings() []string {
+	nodes, ok := r.value.([]xpathNode)
+
+	if !ok {
+		return []string{r.String()}
+	}
+
+	values := make([]string, len(nodes))
+
+	for i, node := range nodes {
+		values[i] = r.evaluator.stringValue(node)
+	}
+
+	return values
+}
+
+func (r *XPathResult) String() string {
+	if r.evaluator == nil {
+		return ""
+	}
+
+	return r.evaluator.toString(r.value)
+}
+
+func (r *XPathResult) Number() float64 {
+	if r.evaluator == nil {
+		return math.NaN()
+	}
+
+	return r.evaluator.toNumber(r.value)
+}
+
+func (r *XPathResult) Bool() bool {
+	if r.evaluator == nil {
+		return false
+	}
+
+	return r.evaluator.toBoolean(r.value)
+}
+
+func (x *xpathEvaluator) tagNode(tag *Tag) xpathNode {
+	if tag.parent == nil {
+		return xpathNode{kind: xpathRootNode, tag: x.parser.root}
+	}
+
+	return xpathNode{kind: xpathElementNode, tag: tag}
+}
+
+func (x *xpathEvaluator) children(n xpathNode) []xpathNode {
+	if n.kind != xpathRootNode && n.kind != xpathElementNode {
+		return nil
+	}
+
+	contentNodes := x.parser.contentNodes(n.tag)
+	nodes := make([]xpathNode, 0, len(contentNodes))
+
+	for _, node := range contentNodes {
+		switch node.Type {
+		case ElementNode:
+			nodes = append(nodes, xpathNode{kind: xpathElementNode, tag: node.Tag})
+		case TextNode:
+			nodes = append(nodes, xpathNode{kind: xpathTextNode, tag: n.tag, offset: node.Offset, data: node.Data})
+		case CDataNode:
+			// the text is read from the whole section, which unwraps it
+			nodes = append(nodes, xpathNode{kind: xpathTextNode, tag: n.tag, offset: node.Offset, data: node.Offset})
+		case CommentNode:
+			nodes = append(nodes, xpathNode{kind: xpathCommentNode, tag: n.tag, offset: node.Offset, data: node.Data})
+		case ProcessingInstructionNode:
+			target, data := x.parser.instruction(node.Data)
+			nodes = append(nodes, xpathNode{kind: xpathProcessingInstructionNode, tag: n.tag, name: target, offset: node.Offset, data: data})
+		}
+	}
+
+	return nodes
+}
+
+func (x *xpathEvaluator) parent(n xpathNode) (xpathNode, bool) {
+	switch n.kind {
+	case xpathRootNode:
+		return xpathNode{}, false
+	case xpathElementNode:
+		if n.tag.parent == nil {
+			return xpathNode{}, false
+		}
+
+		return x.tagNode(n.tag.parent), true
+	}
+
+	return x.tagNode(n.tag), true
+}
+
+func (x *xpathEvaluator) attributes(n xpathNode) []xpathNode {
+	if n.kind != xpathElementNode {
+		return nil
+	}
+
+	names := make([]string, 0, len(n.tag.Attributes))
+
+	for name := range n.tag.Attributes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	nodes := make([]xpathNode, len(names))
+
+	for i, name := range names {
+		nodes[i] = xpathNode{kind: xpathAttributeNode, tag: n.tag, name: name, order: i + 1}
+	}
+
+	return nodes
+}
+
+func (x *xpathEvaluator) descendants(n xpathNode, nodes []xpathNode) []xpathNode {
+	for _, child := range x.children(n) {
+		nodes = append(nodes, child)
+		nodes = x.descendants(child, nodes)
+	}
+
+	return nodes
+}
+
+func (x *xpathEvaluator) ancestors(n xpathNode) []xpathNode {
+	nodes := make([]xpathNode, 0)
+
+	for parent, ok := x.parent(n); ok; parent, ok = x.parent(parent) {
+		nodes = append(nodes, parent)
+	}
+
+	return nodes
+}
+
+// the siblings after the node, or before it in reverse order
+func (x *xpathEvaluator) siblings(n xpathNode, following bool) []xpathNode {
+	parent, ok := x.parent(n)
+
+	if !ok || n.kind == xpathAttributeNode {
+		return nil
+	}
+
+	children := x.children(parent)
+	nodes := make([]xpathNode, 0)
+
+	for i, child := range children {
+		if child != n {
+			continue
+		}
+
+		if following {
+			return append(nodes, children[i+1:]...)
+		}
+
+		for k := i - 1; k >= 0; k-- {
+			nodes = append(nodes, children[k])
+		}
+
+		return nodes
+	}
+
+	return nodes
+}
+
+func (x *xpathEvaluator) axis(name string, n xpathNode) []xpathNode {
+	switch name {
+	case "self":
+		return []xpathNode{n}
+	case "child":
+		return x.children(n)
+	case "attribute":
+		return x.attributes(n)
+	case "parent":
+		if parent, ok := x.parent(n); ok {
+			return []xpathNode{parent}
+		}
+	case "ancestor":
+		return x.ancestors(n)
+	case "ancestor-or-self":
+		return append([]xpathNode{n}, x.ancestors(n)...)
+	case "descendant":
+		return x.descendants(n, nil)
+	case "descendant-or-self":
+		return x.descendants(n, []xpathNode{n})
+	case "following-sibling":
+		return x.siblings(n, true)
+	case "preceding-sibling":
+		return x.siblings(n, false)
+	case "following":
+		nodes := make([]xpathNode, 0)
+
+		for current, ok := n, true; ok; current, ok = x.parent(current) {
+			if current.kind == xpathAttributeNode {
+				continue
+			}
+
+			for _, sibling := range x.siblings(current, true) {
+				nodes = x.descendants(sibling, append(nodes, sibling))
+			}
+		}
+
+		return nodes
+	case "preceding":
+		nodes := make([]xpathNode, 0)
+
+		for current, ok := n, true; ok; current, ok = x.parent(current) {
+			if current.kind == xpathAttributeNode {
+				continue
+			}
+
+			for _, sibling := range x.siblings(current, false) {
+				descendants := x.descendants(sibling, nil)
+
+				for i := len(descendants) - 1; i >= 0; i-- {
+					nodes = append(nodes, descendants[i])
+				}
+
+				nodes = append(nodes, sibling)
+			}
+		}
+
+		return nodes
+	}
+
+	return nil
+}
+
+func (x *xpathEvaluator) matchTest(test xpathTest, axis string, n xpathNode) bool {
+	switch test.kind {
+	case xpathTestNode:
+		return true
+	case xpathTestText:
+		return n.kind == xpathTextNode
+	case xpathTestComment:
+		return n.kind == xpathCommentNode
+	case xpathTestProcessingInstruction:
+		return n.kind == xpathProcessingInstructionNode && (test.local == "" || n.name == test.local)
+	}
+
+	if axis == "attribute" {
+		if n.kind != xpathAttributeNode {
+			return false
+		}
+
+		if test.prefix != "" {
+			return n.name == test.prefix+":"+test.local || (test.local == "*" && len(n.name) > len(test.prefix) && n.name[:len(test.prefix)+1] == test.prefix+":")
+		}
+
+		return test.local == "*" || n.name == x.parser.normalizeName(test.local)
+	}
+
+	if n.kind != xpathElementNode {
+		return false
+	}
+
+	if test.prefix != "" {
+		if !x.parser.inNamespace(n.tag, test.prefix) {
+			return false
+		}
+	} else if test.local != "*" && n.tag.Namespace != "" {
+		return false
+	}
+
+	return test.local == "*" || n.tag.Name == x.parser.normalizeName(test.local)
+}
+
+// orders nodes by their position in the document, attributes follow the
+// element owning them
+func (x *xpathEvaluator) sortNodes(nodes []xpathNode) []xpathNode {
+	position := func(n xpathNode) int {
+		switch n.kind {
+		case xpathRootNode:
+			return -1
+		case xpathElementNode, xpathAttributeNode:
+			return n.tag.Tag.Start
+		}
+
+		return n.offset.Start
+	}
+
+	sort.SliceStable(nodes, func(a, b int) bool {
+		if left, right := position(nodes[a]), position(nodes[b]); left != right {
+			return left < right
+		}
+
+		return nodes[a].order < nodes[b].order
+	})
+
+	unique := nodes[:0]
+
+	for i, node := range nodes {
+		if i == 0 || node != nodes[i-1] {
+			unique = append(unique, node)
+		}
+	}
+
+	return unique
+}
+
+func (x *xpathEvaluator) stringValue(n xpathNode) string {
+	switch n.kind {
+	case xpathAttributeNode:
+		return n.tag.Attributes[n.name]
+	case xpathTextNode:
+		return x.parser.text(n.tag, n.data.Start, n.data.End)
+	case xpathCommentNode, xpathProcessingInstructionNode:
+		return x.parser.value(n.data.Start, n.data.End)
+	}
+
+	var builder bytes.Buffer
+
+	for _, node := range x.descendants(n, nil) {
+		if node.kind == xpathTextNode {
+			builder.WriteString(x.stringValue(node))
+		}
+	}
+
+	return builder.String()
+}
+
+func (e *xpathString) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	return e.value
+}
+
+func (e *xpathNumeric) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	return e.value
+}
+
+func (e *xpathNegate) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	return -x.toNumber(e.expr.evaluate(x, ctx))
+}
+
+func (e *xpathCall) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	return e.function.call(x, ctx, e.args)
+}
+
+func (e *xpathBinary) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	switch e.operator {
+	case "or":
+		return x.toBoolean(e.left.evaluate(x, ctx)) || x.toBoolean(e.right.evaluate(x, ctx))
+	case "and":
+		return x.toBoolean(e.left.evaluate(x, ctx)) && x.toBoolean(e.right.evaluate(x, ctx))
+	}
+
+	left, right := e.left.evaluate(x, ctx), e.right.evaluate(x, ctx)
+
+	switch e.operator {
+	case "|":
+		return x.sortNodes(append(x.nodeSet(left), x.nodeSet(right)...))
+	case "=", "!=", "<", "<=", ">", ">=":
+		return x.compare(e.operator, left, right)
+	case "+":
+		return x.toNumber(left) + x.toNumber(right)
+	case "-":
+		return x.toNumber(left) - x.toNumber(right)
+	case "*":
+		return x.toNumber(left) * x.toNumber(right)
+	case "div":
+		return x.toNumber(left) / x.toNumber(right)
+	case "mod":
+		return math.Mod(x.toNumber(left), x.toNumber(right))
+	}
+
+	return nil
+}
+
+func (e *xpathFilter) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	nodes := x.nodeSet(e.primary.evaluate(x, ctx))
+
+	for _, predicate := range e.predicates {
+		nodes = x.filter(nodes, predicate)
+	}
+
+	return nodes
+}
+
+func (e *xpathPath) evaluate(x *xpathEvaluator, ctx xpathContext) any {
+	var nodes []xpathNode
+
+	switch {
+	case e.filter != nil:
+		nodes = x.nodeSet(e.filter.evaluate(x, ctx))
+	case e.absolute:
+		nodes = []xpathNode{x.tagNode(x.parser.root)}
+	default:
+		nodes = []xpathNode{ctx.node}
+	}
+
+	for _, step := range e.steps {
+		selected := make([]xpathNode, 0)
+
+		for _, node := range nodes {
+			candidates := make([]xpathNode, 0)
+
+			for _, candidate := range x.axis(step.axis, node) {
+				if x.matchTest(step.test, step.axis, candidate) {
+					candidates = append(candidates, candidate)
+				}
+			}
+
+			for _, predicate := range step.predicates {
+				candidates = x.filter(candidates, predicate)
+			}
+
+			selected = append(selected, candidates...)
+		}
+
+		nodes = x.sortNodes(selected)
+	}
+
+	return nodes
+}
+
+// keeps the nodes for which the predicate holds, a number compares against
+// the position along the axis
+func (x *xpathEvaluator) filter(nodes []xpathNode, predicate xpathExpr) []xpathNode {
+	filtered := make([]xpathNode, 0, len(nodes))
+
+	for i, node := range nodes {
+		value := predicate.evaluate(x, xpathContext{node, i + 1, len(nodes)})
+
+		if number, ok := value.(float64); ok {
+			if number == float64(i+1) {
+				filtered = append(filtered, node)
+			}
+		} else if x.toBoolean(value) {
+			filtered = append(filtered, node)
+		}
+	}
+
+	return filtered
+}
+
+func (x *xpathEvaluator) nodeSet(value any) []xpathNode {
+	nodes, ok := value.([]xpathNode)
+
+	if !ok {
+		x.fail("expression does not evaluate to a node-set")
+	}
+
+	return nodes
+}
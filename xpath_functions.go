@@ -0,0 +1,484 @@
+package parseur
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type xpathFunction struct {
+	min  int
+	max  int
+	call func(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any
+}
+
+var xpathFunctions = map[string]*xpathFunction{
+	"last":             {0, 0, xpathLast},
+	"position":         {0, 0, xpathPosition},
+	"count":            {1, 1, xpathCount},
+	"id":               {1, 1, xpathId},
+	"local-name":       {0, 1, xpathLocalName},
+	"namespace-uri":    {0, 1, xpathNamespaceUri},
+	"name":             {0, 1, xpathNameOf},
+	"string":           {0, 1, xpathStringOf},
+	"concat":           {2, -1, xpathConcat},
+	"starts-with":      {2, 2, xpathStartsWith},
+	"contains":         {2, 2, xpathContains},
+	"substring-before": {2, 2, xpathSubstringBefore},
+	"substring-after":  {2, 2, xpathSubstringAfter},
+	"substring":        {2, 3, xpathSubstring},
+	"string-length":    {0, 1, xpathStringLength},
+	"normalize-space":  {0, 1, xpathNormalizeSpace},
+	"translate":        {3, 3, xpathTranslate},
+	"boolean":          {1, 1, xpathBooleanOf},
+	"not":              {1, 1, xpathNot},
+	"true":             {0, 0, xpathTrue},
+	"false":            {0, 0, xpathFalse},
+	"lang":             {1, 1, xpathLang},
+	"number":           {0, 1, xpathNumberOf},
+	"sum":              {1, 1, xpathSum},
+	"floor":            {1, 1, xpathFloor},
+	"ceiling":          {1, 1, xpathCeiling},
+	"round":            {1, 1, xpathRound},
+}
+
+func (x *xpathEvaluator) stringArg(ctx xpathContext, args []xpathExpr, i int) string {
+	return x.toString(args[i].evaluate(x, ctx))
+}
+
+func (x *xpathEvaluator) numberArg(ctx xpathContext, args []xpathExpr, i int) float64 {
+	return x.toNumber(args[i].evaluate(x, ctx))
+}
+
+// the node-set argument or the context node if it was omitted
+func (x *xpathEvaluator) nodeArg(ctx xpathContext, args []xpathExpr) (xpathNode, bool) {
+	if len(args) == 0 {
+		return ctx.node, true
+	}
+
+	nodes := x.nodeSet(args[0].evaluate(x, ctx))
+
+	if len(nodes) == 0 {
+		return xpathNode{}, false
+	}
+
+	return nodes[0], true
+}
+
+// the string argument or the string-value of the context node
+func (x *xpathEvaluator) contextString(ctx xpathContext, args []xpathExpr) string {
+	if len(args) == 0 {
+		return x.stringValue(ctx.node)
+	}
+
+	return x.stringArg(ctx, args, 0)
+}
+
+func xpathLast(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return float64(ctx.size)
+}
+
+func xpathPosition(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return float64(ctx.position)
+}
+
+func xpathCount(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return float64(len(x.nodeSet(args[0].evaluate(x, ctx))))
+}
+
+func xpathId(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	var ids []string
+	value := args[0].evaluate(x, ctx)
+
+	if nodes, ok := value.([]xpathNode); ok {
+		for _, node := range nodes {
+			ids = append(ids, strings.Fields(x.stringValue(node))...)
+		}
+	} else {
+		ids = strings.Fields(x.toString(value))
+	}
+
+	nodes := make([]xpathNode, 0)
+
+	for _, id := range ids {
+		if tags := x.parser.GetTags("#" + id); tags != nil {
+			nodes = append(nodes, x.tagNode((*tags)[0]))
+		}
+	}
+
+	return x.sortNodes(nodes)
+}
+
+func xpathLocalName(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	node, ok := x.nodeArg(ctx, args)
+
+	if !ok {
+		return ""
+	}
+
+	switch node.kind {
+	case xpathElementNode:
+		return node.tag.Name
+	case xpathAttributeNode:
+		if _, local, ok := strings.Cut(node.name, ":"); ok {
+			return local
+		}
+
+		return node.name
+	case xpathProcessingInstructionNode:
+		return node.name
+	}
+
+	return ""
+}
+
+func xpathNamespaceUri(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	node, ok := x.nodeArg(ctx, args)
+
+	if !ok || node.kind != xpathElementNode {
+		return ""
+	}
+
+	return x.parser.namespaceURI(node.tag)
+}
+
+func xpathNameOf(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	node, ok := x.nodeArg(ctx, args)
+
+	if !ok {
+		return ""
+	}
+
+	switch node.kind {
+	case xpathElementNode:
+		if node.tag.Namespace != "" {
+			return node.tag.Namespace + ":" + node.tag.Name
+		}
+
+		return node.tag.Name
+	case xpathAttributeNode, xpathProcessingInstructionNode:
+		return node.name
+	}
+
+	return ""
+}
+
+func xpathStringOf(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return x.contextString(ctx, args)
+}
+
+func xpathConcat(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	builder := strings.Builder{}
+
+	for i := range args {
+		builder.WriteString(x.stringArg(ctx, args, i))
+	}
+
+	return builder.String()
+}
+
+func xpathStartsWith(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return strings.HasPrefix(x.stringArg(ctx, args, 0), x.stringArg(ctx, args, 1))
+}
+
+func xpathContains(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return strings.Contains(x.stringArg(ctx, args, 0), x.stringArg(ctx, args, 1))
+}
+
+func xpathSubstringBefore(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	before, _, _ := strings.Cut(x.stringArg(ctx, args, 0), x.stringArg(ctx, args, 1))
+	return before
+}
+
+func xpathSubstringAfter(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	_, after, _ := strings.Cut(x.stringArg(ctx, args, 0), x.stringArg(ctx, args, 1))
+	return after
+}
+
+// characters are kept if round(start) <= position < round(start)+round(length)
+func xpathSubstring(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	value := x.stringArg(ctx, args, 0)
+	start := xpathRoundValue(x.numberArg(ctx, args, 1))
+	end := math.Inf(1)
+
+	if len(args) == 3 {
+		end = start + xpathRoundValue(x.numberArg(ctx, args, 2))
+	}
+
+	builder := strings.Builder{}
+	position := 1.0
+
+	for _, r := range value {
+		if position >= start && position < end {
+			builder.WriteRune(r)
+		}
+
+		position++
+	}
+
+	return builder.String()
+}
+
+func xpathStringLength(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return float64(utf8.RuneCountInString(x.contextString(ctx, args)))
+}
+
+func xpathNormalizeSpace(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return strings.Join(strings.Fields(x.contextString(ctx, args)), " ")
+}
+
+func xpathTranslate(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	from := []rune(x.stringArg(ctx, args, 1))
+	to := []rune(x.stringArg(ctx, args, 2))
+	builder := strings.Builder{}
+
+	for _, r := range x.stringArg(ctx, args, 0) {
+		index := -1
+
+		for i, candidate := range from {
+			if candidate == r {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			builder.WriteRune(r)
+		} else if index < len(to) {
+			builder.WriteRune(to[index])
+		}
+	}
+
+	return builder.String()
+}
+
+func xpathBooleanOf(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return x.toBoolean(args[0].evaluate(x, ctx))
+}
+
+func xpathNot(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return !x.toBoolean(args[0].evaluate(x, ctx))
+}
+
+func xpathTrue(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return true
+}
+
+func xpathFalse(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return false
+}
+
+func xpathLang(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	lang := strings.ToLower(x.stringArg(ctx, args, 0))
+
+	for node, ok := ctx.node, true; ok; node, ok = x.parent(node) {
+		if node.kind != xpathElementNode {
+			continue
+		}
+
+		value, found := node.tag.Attributes["xml:lang"]
+
+		if !found {
+			value, found = node.tag.Attributes["lang"]
+		}
+
+		if found {
+			value = strings.ToLower(value)
+			return value == lang || strings.HasPrefix(value, lang+"-")
+		}
+	}
+
+	return false
+}
+
+func xpathNumberOf(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	if len(args) == 0 {
+		return x.toNumber(x.stringValue(ctx.node))
+	}
+
+	return x.numberArg(ctx, args, 0)
+}
+
+func xpathSum(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	sum := 0.0
+
+	for _, node := range x.nodeSet(args[0].evaluate(x, ctx)) {
+		sum += x.toNumber(x.stringValue(node))
+	}
+
+	return sum
+}
+
+func xpathFloor(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return math.Floor(x.numberArg(ctx, args, 0))
+}
+
+func xpathCeiling(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return math.Ceil(x.numberArg(ctx, args, 0))
+}
+
+func xpathRound(x *xpathEvaluator, ctx xpathContext, args []xpathExpr) any {
+	return xpathRoundValue(x.numberArg(ctx, args, 0))
+}
+
+func xpathRoundValue(value float64) float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return value
+	}
+
+	return math.Floor(value + 0.5)
+}
+
+func (x *xpathEvaluator) toString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NaN"
+		case math.IsInf(v, 1):
+			return "Infinity"
+		case math.IsInf(v, -1):
+			return "-Infinity"
+		case v == 0:
+			return "0"
+		}
+
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []xpathNode:
+		if len(v) == 0 {
+			return ""
+		}
+
+		return x.stringValue(v[0])
+	}
+
+	return ""
+}
+
+func (x *xpathEvaluator) toNumber(value any) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+
+		return 0
+	}
+
+	text := strings.TrimSpace(x.toString(value))
+	digits := strings.TrimPrefix(text, "-")
+
+	// only plain decimals are numbers, no exponents or signs beyond one '-'
+	if digits == "" || digits == "." || strings.Trim(digits, "0123456789.") != "" || strings.Count(digits, ".") > 1 {
+		return math.NaN()
+	}
+
+	number, err := strconv.ParseFloat(text, 64)
+
+	if err != nil {
+		return math.NaN()
+	}
+
+	return number
+}
+
+func (x *xpathEvaluator) toBoolean(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	case []xpathNode:
+		return len(v) > 0
+	}
+
+	return false
+}
+
+// node-sets compare true if any of their nodes does
+func (x *xpathEvaluator) compare(operator string, left, right any) bool {
+	leftNodes, leftIsSet := left.([]xpathNode)
+	rightNodes, rightIsSet := right.([]xpathNode)
+
+	switch {
+	case leftIsSet && rightIsSet:
+		for _, l := range leftNodes {
+			for _, r := range rightNodes {
+				if x.compareValues(operator, x.stringValue(l), x.stringValue(r)) {
+					return true
+				}
+			}
+		}
+
+		return false
+	case leftIsSet:
+		if _, ok := right.(bool); ok {
+			return x.compareValues(operator, len(leftNodes) > 0, right)
+		}
+
+		for _, l := range leftNodes {
+			if x.compareValues(operator, x.stringValue(l), right) {
+				return true
+			}
+		}
+
+		return false
+	case rightIsSet:
+		if _, ok := left.(bool); ok {
+			return x.compareValues(operator, left, len(rightNodes) > 0)
+		}
+
+		for _, r := range rightNodes {
+			if x.compareValues(operator, left, x.stringValue(r)) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return x.compareValues(operator, left, right)
+}
+
+func (x *xpathEvaluator) compareValues(operator string, left, right any) bool {
+	if operator == "=" || operator == "!=" {
+		var equal bool
+		_, leftIsBool := left.(bool)
+		_, rightIsBool := right.(bool)
+		_, leftIsNumber := left.(float64)
+		_, rightIsNumber := right.(float64)
+
+		switch {
+		case leftIsBool || rightIsBool:
+			equal = x.toBoolean(left) == x.toBoolean(right)
+		case leftIsNumber || rightIsNumber:
+			equal = x.toNumber(left) == x.toNumber(right)
+		default:
+			equal = x.toString(left) == x.toString(right)
+		}
+
+		return equal == (operator == "=")
+	}
+
+	l, r := x.toNumber(left), x.toNumber(right)
+
+	switch operator {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+
+	return l >= r
+}
@@ -0,0 +1,642 @@
+package parseur
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type xpathTokenKind int
+
+const (
+	xpathEnd xpathTokenKind = iota
+	xpathName
+	xpathNumber
+	xpathLiteral
+	xpathOperator
+	xpathSymbol
+)
+
+type xpathToken struct {
+	kind   xpathTokenKind
+	value  string
+	offset int
+}
+
+type xpathExpr interface {
+	evaluate(x *xpathEvaluator, ctx xpathContext) any
+}
+
+type xpathBinary struct {
+	operator string
+	left     xpathExpr
+	right    xpathExpr
+}
+
+type xpathNegate struct {
+	expr xpathExpr
+}
+
+type xpathString struct {
+	value string
+}
+
+type xpathNumeric struct {
+	value float64
+}
+
+type xpathCall struct {
+	function *xpathFunction
+	args     []xpathExpr
+}
+
+type xpathFilter struct {
+	primary    xpathExpr
+	predicates []xpathExpr
+}
+
+type xpathPath struct {
+	absolute bool
+	filter   xpathExpr
+	steps    []*xpathStep
+}
+
+type xpathStep struct {
+	axis       string
+	test       xpathTest
+	predicates []xpathExpr
+}
+
+type xpathTestKind int
+
+const (
+	xpathTestName xpathTestKind = iota
+	xpathTestNode
+	xpathTestText
+	xpathTestComment
+	xpathTestProcessingInstruction
+)
+
+type xpathTest struct {
+	kind   xpathTestKind
+	prefix string
+	local  string
+}
+
+var xpathAxes = map[string]bool{
+	"ancestor":           true,
+	"ancestor-or-self":   true,
+	"attribute":          false,
+	"child":              false,
+	"descendant":         false,
+	"descendant-or-self": false,
+	"following":          false,
+	"following-sibling":  false,
+	"namespace":          false,
+	"parent":             true,
+	"preceding":          true,
+	"preceding-sibling":  true,
+	"self":               false,
+}
+
+var xpathNodeTypes = map[string]xpathTestKind{
+	"node":                   xpathTestNode,
+	"text":                   xpathTestText,
+	"comment":                xpathTestComment,
+	"processing-instruction": xpathTestProcessingInstruction,
+}
+
+var xpathOperatorNames = map[string]struct{}{
+	"and": {}, "or": {}, "div": {}, "mod": {},
+}
+
+type xpathParser struct {
+	expr   string
+	tokens []xpathToken
+	index  int
+}
+
+func parseXPath(expr string) (xpathExpr, error) {
+	tokens, err := tokenizeXPath(expr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &xpathParser{expr: expr, tokens: tokens}
+	result, err := parser.parse()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func tokenizeXPath(expr string) ([]xpathToken, *XPathError) {
+	tokens := make([]xpathToken, 0)
+	length := len(expr)
+
+	for i := 0; i < length; {
+		c := expr[i]
+		start := i
+
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expr[i+1:], c)
+
+			if end == -1 {
+				return nil, &XPathError{expr, i, "unterminated literal"}
+			}
+
+			i += end + 2
+			tokens = append(tokens, xpathToken{xpathLiteral, expr[start+1 : i-1], start})
+			continue
+		case isDigit(c) || (c == '.' && i+1 < length && isDigit(expr[i+1])):
+			for i < length && isDigit(expr[i]) {
+				i++
+			}
+
+			if i < length && expr[i] == '.' {
+				for i++; i < length && isDigit(expr[i]); i++ {
+				}
+			}
+
+			tokens = append(tokens, xpathToken{xpathNumber, expr[start:i], start})
+			continue
+		case isNameStartChar(c):
+			i = skipNCName(expr, i)
+
+			// a prefixed name or a wildcard within a namespace
+			if i+1 < length && expr[i] == ':' && expr[i+1] != ':' {
+				if expr[i+1] == '*' {
+					i += 2
+				} else if isNameStartChar(expr[i+1]) {
+					i = skipNCName(expr, i+1)
+				}
+			}
+
+			kind := xpathName
+
+			if _, ok := xpathOperatorNames[expr[start:i]]; ok && precedesOperator(tokens) {
+				kind = xpathOperator
+			}
+
+			tokens = append(tokens, xpathToken{kind, expr[start:i], start})
+			continue
+		}
+
+		symbol := expr[i : i+1]
+
+		if i+1 < length {
+			switch pair := expr[i : i+2]; pair {
+			case "//", "::", "..", "!=", "<=", ">=":
+				symbol = pair
+			}
+		}
+
+		i += len(symbol)
+
+		switch symbol {
+		case "*":
+			if precedesOperator(tokens) {
+				tokens = append(tokens, xpathToken{xpathOperator, symbol, start})
+			} else {
+				tokens = append(tokens, xpathToken{xpathName, symbol, start})
+			}
+		case "/", "//", "|", "+", "-", "=", "!=", "<", "<=", ">", ">=":
+			tokens = append(tokens, xpathToken{xpathOperator, symbol, start})
+		case "(", ")", "[", "]", ",", "@", "::", ".", "..", "$":
+			tokens = append(tokens, xpathToken{xpathSymbol, symbol, start})
+		default:
+			return nil, &XPathError{expr, start, fmt.Sprintf("unexpected character '%c'", c)}
+		}
+	}
+
+	return append(tokens, xpathToken{xpathEnd, "", length}), nil
+}
+
+// a '*' or an operator name is an operator only if it follows something
+// that can end an operand
+func precedesOperator(tokens []xpathToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+
+	last := tokens[len(tokens)-1]
+
+	switch last.kind {
+	case xpathOperator:
+		return false
+	case xpathSymbol:
+		return last.value == ")" || last.value == "]" || last.value == "." || last.value == ".."
+	}
+
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameStartChar(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || c == '_' || c >= 0x80
+}
+
+func skipNCName(expr string, i int) int {
+	for i < len(expr) && (isNameStartChar(expr[i]) || isDigit(expr[i]) || expr[i] == '-' || expr[i] == '.') {
+		i++
+	}
+
+	return i
+}
+
+func (xp *xpathParser) peek() xpathToken {
+	return xp.tokens[xp.index]
+}
+
+func (xp *xpathParser) peekAt(offset int) xpathToken {
+	if xp.index+offset >= len(xp.tokens) {
+		return xp.tokens[len(xp.tokens)-1]
+	}
+
+	return xp.tokens[xp.index+offset]
+}
+
+func (xp *xpathParser) next() xpathToken {
+	token := xp.tokens[xp.index]
+
+	if token.kind != xpathEnd {
+		xp.index++
+	}
+
+	return token
+}
+
+func (xp *xpathParser) is(kind xpathTokenKind, value string) bool {
+	token := xp.peek()
+	return token.kind == kind && token.value == value
+}
+
+func (xp *xpathParser) expect(kind xpathTokenKind, value string) *XPathError {
+	if !xp.is(kind, value) {
+		return xp.unexpected()
+	}
+
+	xp.next()
+
+	return nil
+}
+
+func (xp *xpathParser) unexpected() *XPathError {
+	token := xp.peek()
+
+	if token.kind == xpathEnd {
+		return &XPathError{xp.expr, token.offset, "unexpected end of expression"}
+	}
+
+	return &XPathError{xp.expr, token.offset, fmt.Sprintf("unexpected '%s'", token.value)}
+}
+
+func (xp *xpathParser) parse() (xpathExpr, *XPathError) {
+	expr, err := xp.parseBinary(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if xp.peek().kind != xpathEnd {
+		return nil, xp.unexpected()
+	}
+
+	return expr, nil
+}
+
+// binary operators by increasing precedence
+var xpathPrecedence = [][]string{
+	{"or"},
+	{"and"},
+	{"=", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "div", "mod"},
+}
+
+func (xp *xpathParser) parseBinary(level int) (xpathExpr, *XPathError) {
+	if level == len(xpathPrecedence) {
+		return xp.parseUnary()
+	}
+
+	left, err := xp.parseBinary(level + 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := xp.peek()
+
+		if token.kind != xpathOperator || !containsString(xpathPrecedence[level], token.value) {
+			return left, nil
+		}
+
+		xp.next()
+		right, err := xp.parseBinary(level + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &xpathBinary{token.value, left, right}
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (xp *xpathParser) parseUnary() (xpathExpr, *XPathError) {
+	if xp.is(xpathOperator, "-") {
+		xp.next()
+		expr, err := xp.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &xpathNegate{expr}, nil
+	}
+
+	left, err := xp.parsePath()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for xp.is(xpathOperator, "|") {
+		xp.next()
+		right, err := xp.parsePath()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &xpathBinary{"|", left, right}
+	}
+
+	return left, nil
+}
+
+func (xp *xpathParser) parsePath() (xpathExpr, *XPathError) {
+	path := &xpathPath{}
+
+	if xp.is(xpathOperator, "/") {
+		xp.next()
+		path.absolute = true
+
+		if !xp.startsStep() {
+			return path, nil
+		}
+	} else if xp.is(xpathOperator, "//") {
+		xp.next()
+		path.absolute = true
+		path.steps = append(path.steps, descendantOrSelfStep())
+	} else if xp.startsFilter() {
+		filter, err := xp.parseFilter()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !xp.is(xpathOperator, "/") && !xp.is(xpathOperator, "//") {
+			return filter, nil
+		}
+
+		path.filter = filter
+
+		if xp.next().value == "//" {
+			path.steps = append(path.steps, descendantOrSelfStep())
+		}
+	}
+
+	for {
+		step, err := xp.parseStep()
+
+		if err != nil {
+			return nil, err
+		}
+
+		path.steps = append(path.steps, step)
+
+		if xp.is(xpathOperator, "//") {
+			path.steps = append(path.steps, descendantOrSelfStep())
+		} else if !xp.is(xpathOperator, "/") {
+			return path, nil
+		}
+
+		xp.next()
+	}
+}
+
+func descendantOrSelfStep() *xpathStep {
+	return &xpathStep{axis: "descendant-or-self", test: xpathTest{kind: xpathTestNode}}
+}
+
+func (xp *xpathParser) startsStep() bool {
+	token := xp.peek()
+
+	if token.kind == xpathName {
+		return true
+	}
+
+	return token.kind == xpathSymbol && (token.value == "@" || token.value == "." || token.value == "..")
+}
+
+func (xp *xpathParser) startsFilter() bool {
+	token := xp.peek()
+
+	switch token.kind {
+	case xpathNumber, xpathLiteral:
+		return true
+	case xpathSymbol:
+		return token.value == "(" || token.value == "$"
+	case xpathName:
+		_, isNodeType := xpathNodeTypes[token.value]
+		following := xp.peekAt(1)
+
+		return !isNodeType && following.kind == xpathSymbol && following.value == "("
+	}
+
+	return false
+}
+
+func (xp *xpathParser) parseFilter() (xpathExpr, *XPathError) {
+	primary, err := xp.parsePrimary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	predicates, err := xp.parsePredicates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(predicates) == 0 {
+		return primary, nil
+	}
+
+	return &xpathFilter{primary, predicates}, nil
+}
+
+func (xp *xpathParser) parsePrimary() (xpathExpr, *XPathError) {
+	token := xp.next()
+
+	switch token.kind {
+	case xpathLiteral:
+		return &xpathString{token.value}, nil
+	case xpathNumber:
+		value, _ := strconv.ParseFloat(token.value, 64)
+		return &xpathNumeric{value}, nil
+	case xpathName:
+		return xp.parseCall(token)
+	}
+
+	if token.value == "$" {
+		return nil, &XPathError{xp.expr, token.offset, "variables are not supported"}
+	}
+
+	expr, err := xp.parseBinary(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return expr, xp.expect(xpathSymbol, ")")
+}
+
+func (xp *xpathParser) parseCall(name xpathToken) (xpathExpr, *XPathError) {
+	function, ok := xpathFunctions[name.value]
+
+	if !ok {
+		return nil, &XPathError{xp.expr, name.offset, "unknown function " + name.value + "()"}
+	}
+
+	call := &xpathCall{function: function}
+	xp.next()
+
+	for !xp.is(xpathSymbol, ")") {
+		if len(call.args) > 0 {
+			if err := xp.expect(xpathSymbol, ","); err != nil {
+				return nil, err
+			}
+		}
+
+		arg, err := xp.parseBinary(0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		call.args = append(call.args, arg)
+	}
+
+	xp.next()
+
+	if len(call.args) < function.min || (function.max != -1 && len(call.args) > function.max) {
+		return nil, &XPathError{xp.expr, name.offset, "wrong number of arguments to " + name.value + "()"}
+	}
+
+	return call, nil
+}
+
+func (xp *xpathParser) parsePredicates() ([]xpathExpr, *XPathError) {
+	var predicates []xpathExpr
+
+	for xp.is(xpathSymbol, "[") {
+		xp.next()
+		predicate, err := xp.parseBinary(0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := xp.expect(xpathSymbol, "]"); err != nil {
+			return nil, err
+		}
+
+		predicates = append(predicates, predicate)
+	}
+
+	return predicates, nil
+}
+
+func (xp *xpathParser) parseStep() (*xpathStep, *XPathError) {
+	step := &xpathStep{axis: "child"}
+
+	switch {
+	case xp.is(xpathSymbol, "."):
+		xp.next()
+		step.axis = "self"
+		step.test.kind = xpathTestNode
+		return step, nil
+	case xp.is(xpathSymbol, ".."):
+		xp.next()
+		step.axis = "parent"
+		step.test.kind = xpathTestNode
+		return step, nil
+	case xp.is(xpathSymbol, "@"):
+		xp.next()
+		step.axis = "attribute"
+	case xp.peek().kind == xpathName && xp.peekAt(1).kind == xpathSymbol && xp.peekAt(1).value == "::":
+		token := xp.next()
+
+		if _, ok := xpathAxes[token.value]; !ok {
+			return nil, &XPathError{xp.expr, token.offset, "unknown axis " + token.value}
+		}
+
+		step.axis = token.value
+		xp.next()
+	}
+
+	if xp.peek().kind != xpathName {
+		return nil, xp.unexpected()
+	}
+
+	token := xp.next()
+
+	if kind, ok := xpathNodeTypes[token.value]; ok && xp.is(xpathSymbol, "(") {
+		xp.next()
+		step.test.kind = kind
+
+		if kind == xpathTestProcessingInstruction && xp.peek().kind == xpathLiteral {
+			step.test.local = xp.next().value
+		}
+
+		if err := xp.expect(xpathSymbol, ")"); err != nil {
+			return nil, err
+		}
+	} else {
+		step.test.local = token.value
+
+		if prefix, local, ok := strings.Cut(token.value, ":"); ok {
+			step.test.prefix = prefix
+			step.test.local = local
+		}
+	}
+
+	var err *XPathError
+	step.predicates, err = xp.parsePredicates()
+
+	return step, err
+}